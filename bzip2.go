@@ -0,0 +1,588 @@
+package hadoop
+
+import (
+	"fmt"
+	"io"
+)
+
+// Pure Go bzip2 compressor producing standard "BZh" streams, which Hadoop's
+// BZip2Codec, compress/bzip2 and the bzip2 command line tool can decompress.
+// The layout of the code follows compress.c and blocksort.c of the reference
+// implementation, with a simpler prefix doubling sort for the BWT.
+
+const (
+	BZIP2_DEFAULT_BLOCK_SIZE = 9 // bzip2.compress.blocksize, in units of 100k
+
+	bzip2BlockMagic    = 0x314159265359
+	bzip2EndMagic      = 0x177245385090
+	bzip2GroupSize     = 50
+	bzip2MaxCodeLen    = 17
+	bzip2NumIterations = 4
+	bzip2MaxGroups     = 6
+	bzip2MaxAlphaSize  = 258
+)
+
+var bzip2CRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+type bzip2BitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+func (bw *bzip2BitWriter) writeBits(n uint, v uint64) {
+	bw.bits = bw.bits<<n | v&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		bw.n -= 8
+		bw.buf = append(bw.buf, byte(bw.bits>>bw.n))
+	}
+}
+
+func (bw *bzip2BitWriter) pad() {
+	if bw.n > 0 {
+		bw.writeBits(8-bw.n, 0)
+	}
+}
+
+type bzip2Writer struct {
+	w           io.Writer
+	blockSize   int
+	maxBlockLen int
+	block       []byte
+	blockCRC    uint32
+	combinedCRC uint32
+	runByte     byte
+	runLen      int
+	bw          bzip2BitWriter
+	err         error
+	closed      bool
+
+	// per block buffers, kept so that a reset writer reuses them
+	last      []byte
+	symbols   []uint16
+	selectors []byte
+	rotations bzip2Rotations
+	huffman   bzip2Huffman
+	freqs     [bzip2MaxAlphaSize]int32
+	lengths   [bzip2MaxGroups][bzip2MaxAlphaSize]uint8
+	codes     [bzip2MaxGroups][bzip2MaxAlphaSize]uint32
+}
+
+// newBzip2Writer returns a writer compressing to w with the given block size,
+// 1 to 9 in units of 100k like the -1 to -9 flags of bzip2.
+func newBzip2Writer(w io.Writer, blockSize int) *bzip2Writer {
+	z := &bzip2Writer{}
+	z.reset(w, blockSize)
+	return z
+}
+
+// reset makes z a new writer to w, keeping its buffers.
+func (z *bzip2Writer) reset(w io.Writer, blockSize int) {
+	z.w = w
+	z.blockSize = blockSize
+	z.maxBlockLen = blockSize*100000 - 19
+	z.block = z.block[:0]
+	z.blockCRC = 0xffffffff
+	z.combinedCRC = 0
+	z.runByte = 0
+	z.runLen = 0
+	z.bw = bzip2BitWriter{buf: append(z.bw.buf[:0], 'B', 'Z', 'h', byte('0'+blockSize))}
+	z.err = nil
+	z.closed = false
+}
+
+func (z *bzip2Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, fmt.Errorf("bzip2: write to closed writer")
+	}
+	for _, b := range p {
+		if z.runLen > 0 && b == z.runByte && z.runLen < 255 {
+			z.runLen++
+			continue
+		}
+		if z.runLen > 0 {
+			z.flushRun()
+			if len(z.block) >= z.maxBlockLen {
+				if err := z.writeBlock(); err != nil {
+					return 0, err
+				}
+			}
+		}
+		z.runByte = b
+		z.runLen = 1
+	}
+	return len(p), nil
+}
+
+func (z *bzip2Writer) Close() error {
+	if z.err != nil || z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.runLen > 0 {
+		z.flushRun()
+	}
+	if len(z.block) > 0 {
+		if err := z.writeBlock(); err != nil {
+			return err
+		}
+	}
+	z.bw.writeBits(24, bzip2EndMagic>>24)
+	z.bw.writeBits(24, bzip2EndMagic&0xffffff)
+	z.bw.writeBits(32, uint64(z.combinedCRC))
+	z.bw.pad()
+	return z.flush()
+}
+
+func (z *bzip2Writer) flush() error {
+	if _, err := z.w.Write(z.bw.buf); err != nil {
+		z.err = err
+		return err
+	}
+	z.bw.buf = z.bw.buf[:0]
+	return nil
+}
+
+// flushRun adds the pending run to the block. Runs of 4 or more bytes are
+// stored as 4 bytes followed by the number of extra repetitions.
+func (z *bzip2Writer) flushRun() {
+	for i := 0; i < z.runLen; i++ {
+		z.blockCRC = z.blockCRC<<8 ^ bzip2CRCTable[byte(z.blockCRC>>24)^z.runByte]
+	}
+	if z.runLen < 4 {
+		for i := 0; i < z.runLen; i++ {
+			z.block = append(z.block, z.runByte)
+		}
+	} else {
+		z.block = append(z.block, z.runByte, z.runByte, z.runByte, z.runByte, byte(z.runLen-4))
+	}
+	z.runLen = 0
+}
+
+func (z *bzip2Writer) writeBlock() error {
+	crc := ^z.blockCRC
+	z.combinedCRC = (z.combinedCRC<<1 | z.combinedCRC>>31) ^ crc
+	block := z.block
+	n := len(block)
+
+	// Burrows-Wheeler transform
+	ptr := z.rotations.sort(block)
+	origPtr := 0
+	if cap(z.last) < n {
+		z.last = make([]byte, n)
+	}
+	last := z.last[:n]
+	for i, p := range ptr {
+		if p == 0 {
+			origPtr = i
+			last[i] = block[n-1]
+		} else {
+			last[i] = block[p-1]
+		}
+	}
+
+	var inUse [256]bool
+	for _, b := range block {
+		inUse[b] = true
+	}
+	var unseqToSeq [256]byte
+	numInUse := 0
+	for i, used := range inUse {
+		if used {
+			unseqToSeq[i] = byte(numInUse)
+			numInUse++
+		}
+	}
+	alphaSize := numInUse + 2
+	eob := uint16(numInUse + 1)
+
+	// Move-to-front transform, with runs of zeros written in bijective
+	// base 2 using RUNA (0) and RUNB (1).
+	symbols := z.symbols[:0]
+	freqs := z.freqs[:alphaSize]
+	for i := range freqs {
+		freqs[i] = 0
+	}
+	var order [256]byte
+	for i := range order {
+		order[i] = byte(i)
+	}
+	zeros := 0
+	flushZeros := func() {
+		if zeros == 0 {
+			return
+		}
+		zeros--
+		for {
+			symbol := uint16(zeros & 1)
+			symbols = append(symbols, symbol)
+			freqs[symbol]++
+			if zeros < 2 {
+				break
+			}
+			zeros = (zeros - 2) / 2
+		}
+		zeros = 0
+	}
+	for _, b := range last {
+		seq := unseqToSeq[b]
+		j := 0
+		for order[j] != seq {
+			j++
+		}
+		if j == 0 {
+			zeros++
+			continue
+		}
+		flushZeros()
+		copy(order[1:j+1], order[:j])
+		order[0] = seq
+		symbols = append(symbols, uint16(j+1))
+		freqs[j+1]++
+	}
+	flushZeros()
+	symbols = append(symbols, eob)
+	freqs[eob]++
+	z.symbols = symbols
+
+	numGroups := 6
+	switch {
+	case len(symbols) < 200:
+		numGroups = 2
+	case len(symbols) < 600:
+		numGroups = 3
+	case len(symbols) < 1200:
+		numGroups = 4
+	case len(symbols) < 2400:
+		numGroups = 5
+	}
+	lengths := z.lengths[:numGroups]
+	bzip2InitialLengths(lengths, freqs, len(symbols))
+	numSelectors := (len(symbols) + bzip2GroupSize - 1) / bzip2GroupSize
+	if cap(z.selectors) < numSelectors {
+		z.selectors = make([]byte, numSelectors)
+	}
+	selectors := z.selectors[:numSelectors]
+	for iter := 0; iter < bzip2NumIterations; iter++ {
+		var groupFreqs [bzip2MaxGroups][bzip2MaxAlphaSize]int32
+		for s := 0; s < numSelectors; s++ {
+			group := symbols[s*bzip2GroupSize:]
+			if len(group) > bzip2GroupSize {
+				group = group[:bzip2GroupSize]
+			}
+			best, bestCost := 0, -1
+			for t := 0; t < numGroups; t++ {
+				cost := 0
+				for _, symbol := range group {
+					cost += int(lengths[t][symbol])
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = t, cost
+				}
+			}
+			selectors[s] = byte(best)
+			for _, symbol := range group {
+				groupFreqs[best][symbol]++
+			}
+		}
+		for t := 0; t < numGroups; t++ {
+			z.huffman.codeLengths(lengths[t][:alphaSize], groupFreqs[t][:alphaSize], bzip2MaxCodeLen)
+		}
+	}
+	codes := z.codes[:numGroups]
+	for t := range codes {
+		bzip2AssignCodes(codes[t][:alphaSize], lengths[t][:alphaSize])
+	}
+
+	bw := &z.bw
+	bw.writeBits(24, bzip2BlockMagic>>24)
+	bw.writeBits(24, bzip2BlockMagic&0xffffff)
+	bw.writeBits(32, uint64(crc))
+	bw.writeBits(1, 0) // not randomised
+	bw.writeBits(24, uint64(origPtr))
+
+	var inUse16 uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				inUse16 |= 1 << uint(15-i)
+			}
+		}
+	}
+	bw.writeBits(16, inUse16)
+	for i := 0; i < 16; i++ {
+		if inUse16&(1<<uint(15-i)) == 0 {
+			continue
+		}
+		var bits uint64
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				bits |= 1 << uint(15-j)
+			}
+		}
+		bw.writeBits(16, bits)
+	}
+
+	bw.writeBits(3, uint64(numGroups))
+	bw.writeBits(15, uint64(numSelectors))
+	var selectorOrder [6]byte
+	for i := range selectorOrder {
+		selectorOrder[i] = byte(i)
+	}
+	for _, selector := range selectors {
+		j := 0
+		for selectorOrder[j] != selector {
+			j++
+			bw.writeBits(1, 1)
+		}
+		bw.writeBits(1, 0)
+		copy(selectorOrder[1:j+1], selectorOrder[:j])
+		selectorOrder[0] = selector
+	}
+
+	for t := 0; t < numGroups; t++ {
+		current := lengths[t][0]
+		bw.writeBits(5, uint64(current))
+		for _, length := range lengths[t][:alphaSize] {
+			for current < length {
+				bw.writeBits(2, 2)
+				current++
+			}
+			for current > length {
+				bw.writeBits(2, 3)
+				current--
+			}
+			bw.writeBits(1, 0)
+		}
+	}
+
+	for i, symbol := range symbols {
+		t := selectors[i/bzip2GroupSize]
+		bw.writeBits(uint(lengths[t][symbol]), uint64(codes[t][symbol]))
+	}
+
+	z.block = z.block[:0]
+	z.blockCRC = 0xffffffff
+	return z.flush()
+}
+
+// bzip2Rotations holds the arrays for sorting the rotations of a block.
+type bzip2Rotations struct {
+	p, c, pn, cn, count []int32
+}
+
+// sort returns the start positions of the rotations of block in sorted
+// order, using prefix doubling with counting sorts. The result is valid until
+// the next call.
+func (self *bzip2Rotations) sort(block []byte) []int32 {
+	n := len(block)
+	if cap(self.p) < n {
+		self.p = make([]int32, n)
+		self.c = make([]int32, n)
+		self.pn = make([]int32, n)
+		self.cn = make([]int32, n)
+		self.count = make([]int32, n+256)
+	}
+	p, c, pn, cn := self.p[:n], self.c[:n], self.pn[:n], self.cn[:n]
+	count := self.count[:n+256]
+	for i := range count {
+		count[i] = 0
+	}
+
+	for _, b := range block {
+		count[b]++
+	}
+	for i := 1; i < 256; i++ {
+		count[i] += count[i-1]
+	}
+	for i := n - 1; i >= 0; i-- {
+		count[block[i]]--
+		p[count[block[i]]] = int32(i)
+	}
+	c[p[0]] = 0
+	classes := 1
+	for i := 1; i < n; i++ {
+		if block[p[i]] != block[p[i-1]] {
+			classes++
+		}
+		c[p[i]] = int32(classes - 1)
+	}
+
+	for h := 1; h < n && classes < n; h <<= 1 {
+		for i := 0; i < n; i++ {
+			v := int(p[i]) - h
+			if v < 0 {
+				v += n
+			}
+			pn[i] = int32(v)
+		}
+		for i := 0; i < classes; i++ {
+			count[i] = 0
+		}
+		for i := 0; i < n; i++ {
+			count[c[pn[i]]]++
+		}
+		for i := 1; i < classes; i++ {
+			count[i] += count[i-1]
+		}
+		for i := n - 1; i >= 0; i-- {
+			count[c[pn[i]]]--
+			p[count[c[pn[i]]]] = pn[i]
+		}
+		cn[p[0]] = 0
+		classes = 1
+		for i := 1; i < n; i++ {
+			cur, prev := int(p[i])+h, int(p[i-1])+h
+			if cur >= n {
+				cur -= n
+			}
+			if prev >= n {
+				prev -= n
+			}
+			if c[p[i]] != c[p[i-1]] || c[cur] != c[prev] {
+				classes++
+			}
+			cn[p[i]] = int32(classes - 1)
+		}
+		c, cn = cn, c
+	}
+	return p
+}
+
+// bzip2InitialLengths splits the symbols into numGroups ranges of roughly
+// equal frequency, giving each table cheap codes for its own range.
+func bzip2InitialLengths(lengths [][bzip2MaxAlphaSize]uint8, freqs []int32, numSymbols int) {
+	numGroups := len(lengths)
+	remaining := numSymbols
+	start := 0
+	for part := numGroups; part > 0; part-- {
+		target := remaining / part
+		end := start - 1
+		sum := 0
+		for sum < target && end < len(freqs)-1 {
+			end++
+			sum += int(freqs[end])
+		}
+		if end > start && part != numGroups && part != 1 && (numGroups-part)%2 == 1 {
+			sum -= int(freqs[end])
+			end--
+		}
+		table := lengths[part-1][:len(freqs)]
+		for v := range table {
+			if v >= start && v <= end {
+				table[v] = 0
+			} else {
+				table[v] = 15
+			}
+		}
+		start = end + 1
+		remaining -= sum
+	}
+}
+
+// bzip2Huffman holds the arrays for building Huffman codes of up to
+// bzip2MaxAlphaSize symbols.
+type bzip2Huffman struct {
+	weights [bzip2MaxAlphaSize]int64
+	parent  [2*bzip2MaxAlphaSize - 1]int
+	weight  [2*bzip2MaxAlphaSize - 1]int64
+	active  [bzip2MaxAlphaSize]int
+}
+
+// codeLengths computes Huffman code lengths for freqs into lengths,
+// flattening the frequencies until no code is longer than maxLen.
+func (self *bzip2Huffman) codeLengths(lengths []uint8, freqs []int32, maxLen int) {
+	weights := self.weights[:len(freqs)]
+	for i, freq := range freqs {
+		weights[i] = int64(freq)
+		if weights[i] == 0 {
+			weights[i] = 1
+		}
+	}
+	for {
+		if self.build(lengths, weights) <= maxLen {
+			return
+		}
+		for i := range weights {
+			weights[i] = 1 + weights[i]/2
+		}
+	}
+}
+
+// build sets lengths to the depths of the symbols in a Huffman tree for
+// weights and returns the largest depth.
+func (self *bzip2Huffman) build(lengths []uint8, weights []int64) int {
+	n := len(weights)
+	parent := self.parent[:2*n-1]
+	weight := self.weight[:2*n-1]
+	copy(weight, weights)
+	active := self.active[:n]
+	for i := range active {
+		active[i] = i
+	}
+	for next := n; len(active) > 1; next++ {
+		// take the two lightest nodes
+		for k := 0; k < 2; k++ {
+			min := k
+			for i := k + 1; i < len(active); i++ {
+				if weight[active[i]] < weight[active[min]] {
+					min = i
+				}
+			}
+			active[k], active[min] = active[min], active[k]
+		}
+		parent[active[0]] = next
+		parent[active[1]] = next
+		weight[next] = weight[active[0]] + weight[active[1]]
+		active[1] = next
+		active = active[1:]
+	}
+
+	longest := 0
+	root := 2*n - 2
+	for i := 0; i < n; i++ {
+		depth := 0
+		for node := i; node != root; node = parent[node] {
+			depth++
+		}
+		if depth > longest {
+			longest = depth
+		}
+		if depth > 255 {
+			depth = 255
+		}
+		lengths[i] = uint8(depth)
+	}
+	return longest
+}
+
+// Ported from BZ2_hbAssignCodes
+func bzip2AssignCodes(codes []uint32, lengths []uint8) {
+	code := uint32(0)
+	for length := uint8(1); length <= bzip2MaxCodeLen; length++ {
+		for i, l := range lengths {
+			if l == length {
+				codes[i] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+}
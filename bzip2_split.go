@@ -0,0 +1,303 @@
+package hadoop
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+)
+
+// Splittable bzip2 decompression, after Hadoop's BZip2Codec in BYBLOCK mode.
+// A split owns the blocks whose 48-bit block magic starts within its byte
+// range. The magic is not byte aligned, so it is searched bit by bit. Each
+// owned block is cut out of the file and decompressed as a stream of its
+// own: a "BZh9" header, the block bits and an end of stream marker whose
+// combined CRC equals the CRC of the single block.
+
+const (
+	bzip2MagicBits    = 48
+	bzip2MagicMask    = 1<<bzip2MagicBits - 1
+	bzip2ScanSize     = 64 * 1024
+	bzip2MinScanSize  = 512
+	bzip2FirstBlockAt = 4 * 8 // right after the "BZh9" stream header
+)
+
+// bzip2BlockIterator decompresses the blocks of a bzip2 file one by one,
+// starting with the first block at or after a given bit offset.
+type bzip2BlockIterator struct {
+	reader  io.ReaderAt
+	end     int64  // bit offset; blocks starting here or later are not owned
+	next    int64  // bit offset of the next block magic, -1 if there is none
+	scanBuf []byte // grows up to bzip2ScanSize as scans get longer
+	block   []byte
+	stream  bzip2BitWriter
+	data    []byte
+}
+
+func newBzip2BlockIterator(r io.ReaderAt, start int64, end int64) (*bzip2BlockIterator, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("bad split range [%d, %d)", start, end)
+	}
+	it := &bzip2BlockIterator{reader: r, end: end * 8}
+	// small ranges rarely hold a block, so start scanning with a small buffer
+	scanSize := end - start + bzip2MagicBits/8
+	if scanSize < bzip2MinScanSize {
+		scanSize = bzip2MinScanSize
+	} else if scanSize > bzip2ScanSize {
+		scanSize = bzip2ScanSize
+	}
+	it.scanBuf = make([]byte, scanSize)
+	pos, eos, err := it.findMagic(start * 8)
+	for err == nil && eos {
+		pos, eos, err = it.findMagic(pos + bzip2MagicBits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.next = pos
+	return it, nil
+}
+
+// findMagic returns the bit offset of the first block or end of stream magic
+// starting at or after bit offset from, or -1 if there is none.
+func (it *bzip2BlockIterator) findMagic(from int64) (int64, bool, error) {
+	var reg uint64
+	offset := from / 8
+	for {
+		n, err := it.reader.ReadAt(it.scanBuf, offset)
+		for i, b := range it.scanBuf[:n] {
+			reg = reg<<8 | uint64(b)
+			bitEnd := (offset + int64(i) + 1) * 8
+			for shift := 7; shift >= 0; shift-- { // earlier positions first
+				pos := bitEnd - int64(shift) - bzip2MagicBits
+				if pos < from {
+					continue
+				}
+				switch (reg >> uint(shift)) & bzip2MagicMask {
+				case bzip2BlockMagic:
+					return pos, false, nil
+				case bzip2EndMagic:
+					return pos, true, nil
+				}
+			}
+		}
+		offset += int64(n)
+		if n == len(it.scanBuf) && n < bzip2ScanSize {
+			it.scanBuf = make([]byte, 2*n)
+		}
+		if err == io.EOF {
+			return -1, false, nil
+		}
+		if err != nil {
+			return -1, false, err
+		}
+	}
+}
+
+// owned reports whether the next block belongs to the split.
+func (it *bzip2BlockIterator) owned() bool {
+	return it.next >= 0 && it.next < it.end
+}
+
+// nextBlock returns the decompressed data of the next block and whether it
+// belongs to the split. It returns io.EOF after the last block of the file.
+// The data is only valid until the next call.
+func (it *bzip2BlockIterator) nextBlock() ([]byte, bool, error) {
+	if it.next < 0 {
+		return nil, false, io.EOF
+	}
+	start := it.next
+	end, eos, err := it.findMagic(start + bzip2MagicBits)
+	if err != nil {
+		return nil, false, err
+	}
+	if end < 0 {
+		return nil, false, fmt.Errorf("bzip2: truncated block at bit %d", start)
+	}
+	if err := it.decodeBlock(start, end); err != nil {
+		return nil, false, err
+	}
+
+	// skip end of stream markers and the headers of concatenated streams
+	it.next = end
+	for eos && it.next >= 0 {
+		it.next, eos, err = it.findMagic(it.next + bzip2MagicBits)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return it.data, start < it.end, nil
+}
+
+// decodeBlock decompresses the block occupying bits [start, end) of the file.
+func (it *bzip2BlockIterator) decodeBlock(start int64, end int64) error {
+	first := start / 8
+	size := int(end/8 - first + 1)
+	if cap(it.block) < size {
+		it.block = make([]byte, size)
+	}
+	it.block = it.block[:size]
+	// the magic following the block is there, so this cannot hit the end
+	if n, err := it.reader.ReadAt(it.block, first); n < size {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	bitAt := func(pos int64) uint64 {
+		pos -= first * 8
+		return uint64(it.block[pos/8]>>(7-uint(pos%8))) & 1
+	}
+	var blockCRC uint64
+	for pos := start + bzip2MagicBits; pos < start+bzip2MagicBits+32; pos++ {
+		blockCRC = blockCRC<<1 | bitAt(pos)
+	}
+
+	it.stream.buf = append(it.stream.buf[:0], 'B', 'Z', 'h', '9')
+	it.stream.bits, it.stream.n = 0, 0
+	pos := start
+	for ; pos < end && pos%8 != 0; pos++ {
+		it.stream.writeBits(1, bitAt(pos))
+	}
+	for ; pos+8 <= end; pos += 8 {
+		it.stream.writeBits(8, uint64(it.block[pos/8-first]))
+	}
+	for ; pos < end; pos++ {
+		it.stream.writeBits(1, bitAt(pos))
+	}
+	it.stream.writeBits(bzip2MagicBits, bzip2EndMagic)
+	it.stream.writeBits(32, blockCRC)
+	it.stream.pad()
+
+	var err error
+	it.data, err = readAllInto(it.data[:0], bzip2.NewReader(bytes.NewReader(it.stream.buf)), 0)
+	return err
+}
+
+// Bzip2SplitReader decompresses the part of a bzip2 file that belongs to the
+// byte range [start, end): the blocks whose block magic starts in the range.
+// Reading a set of adjacent ranges one after another yields the whole file.
+type Bzip2SplitReader struct {
+	blocks *bzip2BlockIterator
+	data   []byte
+	eof    bool
+}
+
+func NewBzip2SplitReader(r io.ReaderAt, start int64, end int64) (*Bzip2SplitReader, error) {
+	blocks, err := newBzip2BlockIterator(r, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &Bzip2SplitReader{blocks: blocks}, nil
+}
+
+func (self *Bzip2SplitReader) Read(p []byte) (int, error) {
+	for len(self.data) == 0 {
+		if self.eof || !self.blocks.owned() {
+			self.eof = true
+			return 0, io.EOF
+		}
+		data, _, err := self.blocks.nextBlock()
+		if err != nil {
+			return 0, err
+		}
+		self.data = data
+	}
+	n := copy(p, self.data)
+	self.data = self.data[n:]
+	return n, nil
+}
+
+// Bzip2SplitLineReader reads the lines of a bzip2 compressed text file that
+// belong to the byte range [start, end), like Hadoop's LineRecordReader.
+// Unless the range holds the first block of the file, the first line is
+// skipped as it belongs to the previous range. Lines starting at or before
+// the end of the data of the range are returned, reading into the following
+// blocks as needed. Thus every line of the file is returned by exactly one of
+// a set of adjacent ranges.
+type Bzip2SplitLineReader struct {
+	blocks    *bzip2BlockIterator
+	data      []byte // the rest of the current block
+	owned     bool   // whether the current block belongs to the range
+	lastOwned bool   // whether the last byte consumed belonged to the range
+	skipFirst bool
+	started   bool
+	line      []byte
+}
+
+func NewBzip2SplitLineReader(r io.ReaderAt, start int64, end int64) (*Bzip2SplitLineReader, error) {
+	blocks, err := newBzip2BlockIterator(r, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &Bzip2SplitLineReader{
+		blocks:    blocks,
+		skipFirst: blocks.next != bzip2FirstBlockAt,
+	}, nil
+}
+
+// fill makes sure data holds unread bytes. It returns false at end of file.
+func (self *Bzip2SplitLineReader) fill() (bool, error) {
+	for len(self.data) == 0 {
+		data, owned, err := self.blocks.nextBlock()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		self.data, self.owned = data, owned
+	}
+	return true, nil
+}
+
+// readLine appends the bytes up to and including the next newline to line.
+func (self *Bzip2SplitLineReader) readLine(line []byte) ([]byte, error) {
+	for {
+		ok, err := self.fill()
+		if !ok {
+			return line, err
+		}
+		n := bytes.IndexByte(self.data, '\n') + 1
+		if n == 0 {
+			n = len(self.data)
+		}
+		line = append(line, self.data[:n]...)
+		self.data = self.data[n:]
+		self.lastOwned = self.owned
+		if line[len(line)-1] == '\n' {
+			return line, nil
+		}
+	}
+}
+
+// ReadLine returns the next line without its line terminator, or io.EOF
+// after the last line of the range. The line is only valid until the next
+// call.
+func (self *Bzip2SplitLineReader) ReadLine() ([]byte, error) {
+	if !self.started {
+		self.started = true
+		if !self.blocks.owned() {
+			return nil, io.EOF // no line starts in the range
+		}
+		if self.skipFirst {
+			if _, err := self.readLine(self.line[:0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ok, err := self.fill()
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (!self.owned && !self.lastOwned) {
+		return nil, io.EOF // the next line starts past the range
+	}
+	self.line, err = self.readLine(self.line[:0])
+	if err != nil {
+		return nil, err
+	}
+	line := bytes.TrimSuffix(self.line, []byte{'\n'})
+	return bytes.TrimSuffix(line, []byte{'\r'}), nil
+}
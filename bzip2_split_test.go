@@ -0,0 +1,138 @@
+package hadoop
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genBzip2TestFile(t *testing.T) ([]byte, []string) {
+	var text bytes.Buffer
+	var lines []string
+	for i := 0; text.Len() < 1<<20; i++ {
+		key, _ := genTestData(i)
+		line := fmt.Sprintf("%d %x", i, key[:len(key)%100])
+		if i%7 == 0 {
+			line = "" // empty lines must survive too
+		}
+		lines = append(lines, line)
+		text.WriteString(line + "\n")
+	}
+	lines = append(lines, "no trailing newline")
+	text.WriteString("no trailing newline")
+
+	// two concatenated streams with 100k blocks
+	var compressed bytes.Buffer
+	half := text.Len() / 2
+	for _, part := range [][]byte{text.Bytes()[:half], text.Bytes()[half:]} {
+		writer := newBzip2Writer(&compressed, 1)
+		_, err := writer.Write(part)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+	}
+	return compressed.Bytes(), lines
+}
+
+func bzip2SplitRanges(size int64, splitSize int64) [][2]int64 {
+	var ranges [][2]int64
+	for start := int64(0); start < size; start += splitSize {
+		end := start + splitSize
+		if end > size {
+			end = size
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+	return ranges
+}
+
+func TestBzip2SplitReader(t *testing.T) {
+	assert := assert.New(t)
+	compressed, lines := genBzip2TestFile(t)
+	text := []byte(strings.Join(lines, "\n"))
+	file := bytes.NewReader(compressed)
+
+	for _, splitSize := range []int64{int64(len(compressed)), 100000, 33333, 1000} {
+		var joined []byte
+		numNonEmpty := 0
+		for _, r := range bzip2SplitRanges(int64(len(compressed)), splitSize) {
+			reader, err := NewBzip2SplitReader(file, r[0], r[1])
+			assert.NoError(err)
+			data, err := ioutil.ReadAll(reader)
+			assert.NoError(err)
+			if len(data) > 0 {
+				numNonEmpty++
+			}
+			joined = append(joined, data...)
+		}
+		assert.True(bytes.Equal(text, joined), "split size %d", splitSize)
+		if splitSize < 100000 {
+			assert.True(numNonEmpty > 10)
+		}
+	}
+}
+
+func TestBzip2SplitLineReader(t *testing.T) {
+	assert := assert.New(t)
+	compressed, lines := genBzip2TestFile(t)
+	file := bytes.NewReader(compressed)
+
+	for _, splitSize := range []int64{int64(len(compressed)), 100000, 33333, 1000} {
+		var got []string
+		for _, r := range bzip2SplitRanges(int64(len(compressed)), splitSize) {
+			reader, err := NewBzip2SplitLineReader(file, r[0], r[1])
+			assert.NoError(err)
+			for {
+				line, err := reader.ReadLine()
+				if err == io.EOF {
+					break
+				}
+				if !assert.NoError(err) {
+					break
+				}
+				got = append(got, string(line))
+			}
+		}
+		assert.Equal(len(lines), len(got), "split size %d", splitSize)
+		assert.Equal(lines, got, "split size %d", splitSize)
+	}
+}
+
+func TestBzip2SplitLineReaderBoundary(t *testing.T) {
+	assert := assert.New(t)
+	// every block ends exactly with a newline, so each split starts with a
+	// complete line that belongs to the previous split
+	var compressed bytes.Buffer
+	for _, text := range []string{"a\nb\n", "c\nd\n", "e\n"} {
+		writer := newBzip2Writer(&compressed, 1)
+		_, err := writer.Write([]byte(text))
+		assert.NoError(err)
+		assert.NoError(writer.Close())
+	}
+	file := bytes.NewReader(compressed.Bytes())
+	readLines := func(start, end int64) []string {
+		reader, err := NewBzip2SplitLineReader(file, start, end)
+		assert.NoError(err)
+		var lines []string
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				assert.Equal(io.EOF, err)
+				return lines
+			}
+			lines = append(lines, string(line))
+		}
+	}
+	second := int64(bytes.Index(compressed.Bytes()[1:], []byte("BZh")) + 1)
+	third := second + int64(bytes.Index(compressed.Bytes()[second+1:], []byte("BZh"))+1)
+	size := int64(compressed.Len())
+	assert.Equal([]string{"a", "b", "c"}, readLines(0, second))
+	assert.Equal([]string{"d", "e"}, readLines(second, third))
+	assert.Equal([]string(nil), readLines(third, size))
+	assert.Equal([]string(nil), readLines(0, 2))
+	assert.Equal([]string{"a", "b", "c"}, readLines(2, second))
+}
@@ -1,20 +1,34 @@
 package hadoop
 
-// #cgo CFLAGS: -O3
-import "C"
-
 import (
 	"bytes"
 	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
+	// Codecs maps codec class names to the built-in codecs.
+	//
+	// Deprecated: Modifying the map is not safe for concurrent use. Use
+	// RegisterCodec and LookupCodec instead. Entries added here are still
+	// found by LookupCodec, by class name only.
 	Codecs map[string]Codec = map[string]Codec{
-		"org.apache.hadoop.io.compress.DefaultCodec": &ZlibCodec{},
-		"org.apache.hadoop.io.compress.Lz4Codec":     &Lz4Codec{},
-		"org.apache.hadoop.io.compress.BZip2Codec":   &Bzip2Codec{},
+		"org.apache.hadoop.io.compress.DefaultCodec":   &ZlibCodec{},
+		"org.apache.hadoop.io.compress.GzipCodec":      &GzipCodec{},
+		"org.apache.hadoop.io.compress.Lz4Codec":       &Lz4Codec{},
+		"org.apache.hadoop.io.compress.BZip2Codec":     &Bzip2Codec{},
+		"org.apache.hadoop.io.compress.SnappyCodec":    &SnappyCodec{},
+		"org.apache.hadoop.io.compress.ZStandardCodec": &ZStandardCodec{},
+		"com.hadoop.compression.lzo.LzoCodec":          &LzoCodec{},
+		"com.hadoop.compression.lzo.LzopCodec":         &LzopCodec{},
 	}
 )
 
@@ -23,101 +37,586 @@ type Codec interface {
 	Compress(dst, src []byte) ([]byte, error)
 }
 
-type ZlibCodec struct{}
+// LimitedCodec is implemented by codecs that can stop decompressing as soon
+// as the output would exceed limit bytes, returning a *DecompressionLimitError.
+// The limit covers the bytes appended to dst. Zero means no limit. All
+// built-in codecs implement it.
+type LimitedCodec interface {
+	Codec
+	UncompressLimit(dst, src []byte, limit int) ([]byte, error)
+}
 
-func (c *ZlibCodec) Uncompress(dst, src []byte) ([]byte, error) {
-	reader, err := zlib.NewReader(bytes.NewReader(src))
+// DecompressionLimitError tells that decompressed data would have grown past
+// the configured limit, which usually means the input is corrupt or hostile.
+type DecompressionLimitError struct {
+	Limit int
+}
+
+func (e *DecompressionLimitError) Error() string {
+	return fmt.Sprintf("decompressed size exceeds limit of %d bytes", e.Limit)
+}
+
+var (
+	_ LimitedCodec = &ZlibCodec{}
+	_ LimitedCodec = &GzipCodec{}
+	_ LimitedCodec = &Bzip2Codec{}
+	_ LimitedCodec = &Lz4Codec{}
+	_ LimitedCodec = &SnappyCodec{}
+	_ LimitedCodec = &ZStandardCodec{}
+	_ LimitedCodec = &LzoCodec{}
+	_ LimitedCodec = &LzopCodec{}
+	_ LimitedCodec = &BlockCodec{}
+)
+
+// UncompressLimit is like codec.Uncompress, but fails with a
+// *DecompressionLimitError if more than limit bytes would be appended to dst.
+// Codecs that do not implement LimitedCodec are checked after the fact.
+func UncompressLimit(codec Codec, dst, src []byte, limit int) ([]byte, error) {
+	if limited, ok := codec.(LimitedCodec); ok {
+		return limited.UncompressLimit(dst, src, limit)
+	}
+	start := len(dst)
+	dst, err := codec.Uncompress(dst, src)
 	if err != nil {
 		return nil, err
 	}
-	var buf [512]byte
-	for {
-		n, err := reader.Read(buf[:])
-		if err != nil && err != io.EOF {
+	if limit > 0 && len(dst)-start > limit {
+		return nil, &DecompressionLimitError{Limit: limit}
+	}
+	return dst, nil
+}
+
+type CompressionStrategy int
+
+// Mirrors ZlibCompressor.CompressionStrategy
+const (
+	DEFAULT_STRATEGY CompressionStrategy = iota
+	FILTERED
+	HUFFMAN_ONLY
+	RLE
+	FIXED
+)
+
+// NO_COMPRESSION is the Level of CodecOptions for zlib and gzip output that
+// is stored rather than compressed, ZlibCompressor.CompressionLevel's
+// NO_COMPRESSION. It is not zero as in Java, since zero selects the default.
+const NO_COMPRESSION = -1
+
+// CodecOptions tunes the compression side of a codec.
+type CodecOptions struct {
+	// Level is the codec specific compression level, e.g. 1 (best speed) to
+	// 9 (best compression) or NO_COMPRESSION for zlib. Zero selects the codec
+	// default.
+	Level int
+
+	Strategy CompressionStrategy
+
+	// BufferSize is the io.compression.codec.*.buffersize of the codecs built
+	// on BlockCodec (LZ4, Snappy and LZO), which determines how the data is
+	// split into chunks. Other codecs ignore it. Zero selects the default.
+	BufferSize int
+}
+
+// ConfigurableCodec is implemented by codecs that support CodecOptions.
+// WithOptions returns a new codec and leaves the receiver unchanged, so that
+// the shared instances in Codecs can be configured per writer.
+type ConfigurableCodec interface {
+	Codec
+	WithOptions(opts CodecOptions) (Codec, error)
+}
+
+// ConfigureCodec applies opts to codec. Zero options return codec as is.
+func ConfigureCodec(codec Codec, opts CodecOptions) (Codec, error) {
+	if opts == (CodecOptions{}) {
+		return codec, nil
+	}
+	configurable, ok := codec.(ConfigurableCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %T does not support options", codec)
+	}
+	return configurable.WithOptions(opts)
+}
+
+type ZlibCodec struct {
+	level int // as deflateLevel returns it
+}
+
+func (c *ZlibCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	level, err := deflateLevel(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ZlibCodec{level: level}, nil
+}
+
+// deflateLevel validates opts for zlib and gzip. It returns the level, which
+// is CodecOptions.Level, or flate.HuffmanOnly for the HUFFMAN_ONLY strategy.
+// deflateCompressionLevel turns it into a compress/flate level.
+func deflateLevel(opts CodecOptions) (int, error) {
+	if opts.Level < NO_COMPRESSION || opts.Level > flate.BestCompression {
+		return 0, fmt.Errorf("unsupported deflate compression level %d", opts.Level)
+	}
+	level := opts.Level
+	switch opts.Strategy {
+	case DEFAULT_STRATEGY:
+	case HUFFMAN_ONLY:
+		level = flate.HuffmanOnly
+	default:
+		return 0, fmt.Errorf("unsupported deflate compression strategy %d", opts.Strategy)
+	}
+	return level, nil
+}
+
+// The deflate based codecs keep their compressors and decompressors in pools,
+// one pool per compression level, since setting them up costs far more than
+// compressing a typical SequenceFile buffer.
+var (
+	zlibWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+	gzipWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+	zlibReaderPool  sync.Pool
+	gzipReaderPool  sync.Pool
+)
+
+type deflateWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type deflateCompressor struct {
+	writer deflateWriter
+	output appendWriter
+}
+
+type deflateDecompressor struct {
+	reader io.Reader
+	input  bytes.Reader
+}
+
+// deflateCompress appends the compressed src to dst, with a compressor taken
+// from pool or, if the pool is empty, created by newWriter.
+func deflateCompress(pool *sync.Pool, dst, src []byte, newWriter func(w io.Writer) (deflateWriter, error)) ([]byte, error) {
+	compressor, _ := pool.Get().(*deflateCompressor)
+	if compressor == nil {
+		compressor = &deflateCompressor{}
+		writer, err := newWriter(&compressor.output)
+		if err != nil {
 			return nil, err
 		}
-		dst = append(dst, buf[:n]...)
-		if err == io.EOF {
-			break
-		}
+		compressor.writer = writer
+	} else {
+		compressor.writer.Reset(&compressor.output)
+	}
+	compressor.output.buf = dst
+	if _, err := compressor.writer.Write(src); err != nil {
+		return nil, err
 	}
+	if err := compressor.writer.Close(); err != nil {
+		return nil, err
+	}
+	dst = compressor.output.buf
+	compressor.output.buf = nil
+	pool.Put(compressor)
 	return dst, nil
 }
 
-func (c *ZlibCodec) Compress(dst, src []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	writer := zlib.NewWriter(&buf)
-	_, err := writer.Write(src)
+// deflateUncompress appends the uncompressed src to dst, with a decompressor
+// taken from pool. reset points the decompressor at its input, creating the
+// reader if the decompressor is new.
+func deflateUncompress(pool *sync.Pool, dst, src []byte, limit int, reset func(d *deflateDecompressor) error) ([]byte, error) {
+	decompressor, _ := pool.Get().(*deflateDecompressor)
+	if decompressor == nil {
+		decompressor = &deflateDecompressor{}
+	}
+	decompressor.input.Reset(src)
+	if err := reset(decompressor); err != nil {
+		return nil, err
+	}
+	dst, err := readAllInto(dst, decompressor.reader, limit)
 	if err != nil {
 		return nil, err
 	}
-	err = writer.Close()
+	decompressor.input.Reset(nil)
+	pool.Put(decompressor)
+	return dst, nil
+}
+
+// readAllInto appends everything r returns to dst, reading directly into the
+// spare capacity of dst. It fails once more than limit bytes have been read,
+// unless limit is zero.
+func readAllInto(dst []byte, r io.Reader, limit int) ([]byte, error) {
+	start := len(dst)
+	for {
+		if len(dst) == cap(dst) {
+			dst = growSlice(dst, 512)
+		}
+		end := cap(dst)
+		if limit > 0 && end-start > limit {
+			end = start + limit + 1 // one more byte tells if the limit is exceeded
+		}
+		n, err := r.Read(dst[len(dst):end])
+		dst = dst[:len(dst)+n]
+		if limit > 0 && len(dst)-start > limit {
+			return nil, &DecompressionLimitError{Limit: limit}
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *ZlibCodec) compressionLevel() int {
+	return deflateCompressionLevel(c.level)
+}
+
+func deflateCompressionLevel(level int) int {
+	switch level {
+	case 0:
+		return flate.DefaultCompression
+	case NO_COMPRESSION:
+		return flate.NoCompression
+	}
+	return level
+}
+
+func (c *ZlibCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return c.UncompressLimit(dst, src, 0)
+}
+
+func (c *ZlibCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return deflateUncompress(&zlibReaderPool, dst, src, limit, func(d *deflateDecompressor) error {
+		if d.reader == nil {
+			reader, err := zlib.NewReader(&d.input)
+			if err != nil {
+				return err
+			}
+			d.reader = reader
+			return nil
+		}
+		return d.reader.(zlib.Resetter).Reset(&d.input, nil)
+	})
+}
+
+func (c *ZlibCodec) Compress(dst, src []byte) ([]byte, error) {
+	level := c.compressionLevel()
+	return deflateCompress(&zlibWriterPools[level-flate.HuffmanOnly], dst, src, func(w io.Writer) (deflateWriter, error) {
+		return zlib.NewWriterLevel(w, level)
+	})
+}
+
+// GzipCodec handles gzip framing, as opposed to the raw zlib streams of
+// DefaultCodec. Concatenated gzip members are read as one stream.
+type GzipCodec struct {
+	level int // as deflateLevel returns it
+}
+
+func (c *GzipCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	level, err := deflateLevel(opts)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return &GzipCodec{level: level}, nil
+}
+
+func (c *GzipCodec) compressionLevel() int {
+	return deflateCompressionLevel(c.level)
+}
+
+func (c *GzipCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return c.UncompressLimit(dst, src, 0)
+}
+
+func (c *GzipCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return deflateUncompress(&gzipReaderPool, dst, src, limit, func(d *deflateDecompressor) error {
+		if d.reader == nil {
+			reader, err := gzip.NewReader(&d.input)
+			if err != nil {
+				return err
+			}
+			d.reader = reader
+			return nil
+		}
+		return d.reader.(*gzip.Reader).Reset(&d.input)
+	})
+}
+
+func (c *GzipCodec) Compress(dst, src []byte) ([]byte, error) {
+	level := c.compressionLevel()
+	return deflateCompress(&gzipWriterPools[level-flate.HuffmanOnly], dst, src, func(w io.Writer) (deflateWriter, error) {
+		return gzip.NewWriterLevel(w, level)
+	})
 }
 
+// Bzip2Codec compresses with the pure Go encoder in bzip2.go. The compression
+// level of CodecOptions selects the block size, 1 to 9 in units of 100k.
 type Bzip2Codec struct {
+	blockSize int
+}
+
+func (c *Bzip2Codec) WithOptions(opts CodecOptions) (Codec, error) {
+	if opts.Level < 0 || opts.Level > 9 {
+		return nil, fmt.Errorf("unsupported bzip2 block size %d", opts.Level)
+	}
+	if opts.Strategy != DEFAULT_STRATEGY {
+		return nil, fmt.Errorf("unsupported bzip2 compression strategy %d", opts.Strategy)
+	}
+	return &Bzip2Codec{blockSize: opts.Level}, nil
 }
 
 func (c *Bzip2Codec) Compress(dst, src []byte) ([]byte, error) {
-	panic("Bzip2Codec Compress not implemented")
+	blockSize := c.blockSize
+	if blockSize == 0 {
+		blockSize = BZIP2_DEFAULT_BLOCK_SIZE
+	}
+	compressor, _ := bzip2Compressors.Get().(*bzip2Compressor)
+	if compressor == nil {
+		compressor = &bzip2Compressor{}
+	}
+	compressor.output.buf = dst
+	compressor.writer.reset(&compressor.output, blockSize)
+	_, err := compressor.writer.Write(src)
+	if err == nil {
+		err = compressor.writer.Close()
+	}
+	dst = compressor.output.buf
+	compressor.output.buf = nil
+	bzip2Compressors.Put(compressor)
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// bzip2Compressors pools the block buffers of the bzip2 encoder, which are
+// several MB at the default block size. Decompression goes through
+// compress/bzip2, which cannot be reset and allocates per call.
+var bzip2Compressors sync.Pool
+
+type bzip2Compressor struct {
+	writer bzip2Writer
+	output appendWriter
 }
 
 func (c *Bzip2Codec) Uncompress(dst, src []byte) ([]byte, error) {
-	reader := bzip2.NewReader(bytes.NewReader(src))
-	var buf [512]byte
-	for {
-		n, err := reader.Read(buf[:])
-		if err != nil && err != io.EOF {
+	return c.UncompressLimit(dst, src, 0)
+}
+
+func (c *Bzip2Codec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return readAllInto(dst, bzip2.NewReader(bytes.NewReader(src)), limit)
+}
+
+const LZ4_BUFFER_SIZE = 256 * 1024 // io.compression.codec.lz4.buffersize
+
+// Lz4Codec is BlockCodec with the LZ4 block format. CodecOptions.BufferSize
+// is supported and defaults to LZ4_BUFFER_SIZE.
+type Lz4Codec struct {
+	bufferSize int
+}
+
+func (c *Lz4Codec) WithOptions(opts CodecOptions) (Codec, error) {
+	bufferSize, err := blockBufferSize(lz4Compressor{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Lz4Codec{bufferSize: bufferSize}, nil
+}
+
+func (c *Lz4Codec) compressionBufferSize() int {
+	if c.bufferSize == 0 {
+		return LZ4_BUFFER_SIZE
+	}
+	return c.bufferSize
+}
+
+func (c *Lz4Codec) Compress(dst, src []byte) ([]byte, error) {
+	return blockCompress(dst, src, lz4Compressor{}, c.compressionBufferSize())
+}
+
+func (c *Lz4Codec) Uncompress(dst, src []byte) ([]byte, error) {
+	return blockUncompress(dst, src, lz4Compressor{}, 0)
+}
+
+func (c *Lz4Codec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return blockUncompress(dst, src, lz4Compressor{}, limit)
+}
+
+const ZSTD_DEFAULT_LEVEL = 3 // io.compression.codec.zstd.level
+
+// ZStandardCodec reads and writes the plain zstd frames produced by Hadoop 3's
+// native ZStandardCodec. The level of CodecOptions is the zstd compression
+// level, 1 to 22, as io.compression.codec.zstd.level takes it. The pure Go
+// encoder only has four levels, so levels 1 and 2 compress like 1, levels 3
+// to 5 like 3, levels 6 to 9 like 7 and levels 10 to 22 like 11 of the
+// reference implementation, roughly.
+type ZStandardCodec struct {
+	level int
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+	zstdEncoders    sync.Map // zstd.EncoderLevel -> *zstd.Encoder
+
+	// zstdStreamDecoders decode with a limit. DecodeAll can only be limited
+	// per decoder, so these decode as a stream instead.
+	zstdStreamDecoders sync.Pool
+)
+
+func (c *ZStandardCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	if opts.Level < 0 || opts.Level > 22 {
+		return nil, fmt.Errorf("unsupported zstd compression level %d", opts.Level)
+	}
+	if opts.Strategy != DEFAULT_STRATEGY {
+		return nil, fmt.Errorf("unsupported zstd compression strategy %d", opts.Strategy)
+	}
+	return &ZStandardCodec{level: opts.Level}, nil
+}
+
+func (c *ZStandardCodec) encoder() (*zstd.Encoder, error) {
+	level := c.level
+	if level == 0 {
+		level = ZSTD_DEFAULT_LEVEL
+	}
+	encoderLevel := zstd.EncoderLevelFromZstd(level)
+	if encoder, ok := zstdEncoders.Load(encoderLevel); ok {
+		return encoder.(*zstd.Encoder), nil
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := zstdEncoders.LoadOrStore(encoderLevel, encoder)
+	return actual.(*zstd.Encoder), nil
+}
+
+func (c *ZStandardCodec) Compress(dst, src []byte) ([]byte, error) {
+	encoder, err := c.encoder()
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(src, dst), nil
+}
+
+func (c *ZStandardCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil)
+	})
+	if zstdDecoderErr != nil {
+		return nil, zstdDecoderErr
+	}
+	return zstdDecoder.DecodeAll(src, dst)
+}
+
+func (c *ZStandardCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return c.Uncompress(dst, src)
+	}
+	decoder, _ := zstdStreamDecoders.Get().(*zstd.Decoder)
+	if decoder == nil {
+		var err error
+		decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
 			return nil, err
 		}
-		dst = append(dst, buf[:n]...)
-		if err == io.EOF {
-			break
-		}
 	}
+	if err := decoder.Reset(bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	dst, err := readAllInto(dst, decoder, limit)
+	if err != nil {
+		return nil, err
+	}
+	decoder.Reset(nil)
+	zstdStreamDecoders.Put(decoder)
 	return dst, nil
 }
 
-type Lz4Codec struct {
+const SNAPPY_BUFFER_SIZE = 256 * 1024 // io.compression.codec.snappy.buffersize
+
+// SnappyCodec is BlockCodec with raw snappy blocks. CodecOptions.BufferSize
+// is supported and defaults to SNAPPY_BUFFER_SIZE.
+type SnappyCodec struct {
+	bufferSize int
 }
 
-func (c *Lz4Codec) Compress(dst, src []byte) ([]byte, error) {
-	panic("Lz4Codec Compress not implemented")
+func (c *SnappyCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	bufferSize, err := blockBufferSize(snappyCompressor{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &SnappyCodec{bufferSize: bufferSize}, nil
 }
 
-// func lz4DecompressSafe(in, out []byte) (int, error) {
-// 	n := int(C.LZ4_decompress_safe((*C.char)(unsafe.Pointer(&in[0])), (*C.char)(unsafe.Pointer(&out[0])), C.int(len(in)), C.int(len(out))))
-// 	if n < 0 {
-// 		return 0, errors.New("corrupt input")
-// 	}
-// 	return n, nil
-// }
+func (c *SnappyCodec) compressionBufferSize() int {
+	if c.bufferSize == 0 {
+		return SNAPPY_BUFFER_SIZE
+	}
+	return c.bufferSize
+}
 
-func (c *Lz4Codec) Uncompress(dst, src []byte) ([]byte, error) {
-	panic("Lz4Codec Uncompress has been disabled / commented out")
-	// var iptr, optr uint
+func (c *SnappyCodec) Compress(dst, src []byte) ([]byte, error) {
+	return blockCompress(dst, src, snappyCompressor{}, c.compressionBufferSize())
+}
 
-	// osize := uint(binary.BigEndian.Uint32(src[0:]))
-	// iptr += 4
-	// out := make([]byte, osize)
+func (c *SnappyCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return blockUncompress(dst, src, snappyCompressor{}, 0)
+}
 
-	// for optr < osize {
-	// 	iblocksize := uint(binary.BigEndian.Uint32(src[iptr:]))
-	// 	iptr += 4
+func (c *SnappyCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return blockUncompress(dst, src, snappyCompressor{}, limit)
+}
 
-	// 	n, err := lz4DecompressSafe(src[iptr:iptr+iblocksize], out[optr:])
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	optr += uint(n)
-	// 	iptr += iblocksize
-	// }
+type snappyCompressor struct{}
 
-	// return out, nil
+func (snappyCompressor) CompressBlock(dst, src []byte) ([]byte, error) {
+	return snappyCompressBlock(dst, src)
 }
 
-type SnappyCodec struct {
+func (snappyCompressor) UncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	return snappyUncompressBlock(dst, src, maxSize)
+}
+
+func (snappyCompressor) CompressionOverhead(bufferSize int) int {
+	return bufferSize/6 + 32
+}
+
+func snappyCompressBlock(dst, src []byte) ([]byte, error) {
+	n := len(dst)
+	dst = growSlice(dst, snappy.MaxEncodedLen(len(src)))
+	compressed := snappy.Encode(dst[n:cap(dst)], src)
+	return dst[:n+len(compressed)], nil
+}
+
+func snappyUncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	size, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("snappy: chunk larger than block")
+	}
+	// the decoded length comes from the input, so check it is attainable
+	// before allocating: no snappy element expands by more than 64/3
+	if size/22 > len(src) {
+		return nil, fmt.Errorf("snappy: corrupt input")
+	}
+	n := len(dst)
+	dst = growSlice(dst, size)
+	if _, err := snappy.Decode(dst[n:n+size], src); err != nil {
+		return nil, err
+	}
+	return dst[:n+size], nil
+}
+
+// growSlice makes sure buf has room for n more bytes past its length.
+func growSlice(buf []byte, n int) []byte {
+	if cap(buf)-len(buf) >= n {
+		return buf
+	}
+	grown := make([]byte, len(buf), 2*cap(buf)+n)
+	copy(grown, buf)
+	return grown
 }
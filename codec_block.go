@@ -0,0 +1,342 @@
+package hadoop
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RawBlockCompressor compresses chunks of data that carry no framing of their
+// own, like the Compressor and Decompressor pairs Hadoop plugs into
+// BlockCompressorStream. Wrap one in a BlockCodec to get a Codec.
+type RawBlockCompressor interface {
+	// CompressBlock appends the compressed form of src to dst.
+	CompressBlock(dst, src []byte) ([]byte, error)
+
+	// UncompressBlock appends the uncompressed form of src to dst. It fails
+	// if src expands to more than maxSize bytes.
+	UncompressBlock(dst, src []byte, maxSize int) ([]byte, error)
+
+	// CompressionOverhead returns how many bytes compressing bufferSize bytes
+	// may add in the worst case. The framing layer compresses at most
+	// bufferSize minus this many bytes per chunk, as Hadoop does.
+	CompressionOverhead(bufferSize int) int
+}
+
+const DEFAULT_BLOCK_BUFFER_SIZE = 256 * 1024
+
+// BlockCodec frames the chunks of a RawBlockCompressor the way Hadoop's
+// BlockCompressorStream does: every block starts with its uncompressed length
+// as a big-endian int32, followed by one or more chunks, each prefixed with
+// its compressed length. BufferSize corresponds to
+// io.compression.codec.*.buffersize and must match the setting of the Hadoop
+// side. Zero selects DEFAULT_BLOCK_BUFFER_SIZE.
+type BlockCodec struct {
+	Compressor RawBlockCompressor
+	BufferSize int
+}
+
+var _ CompressionCodec = &BlockCodec{}
+
+func (c *BlockCodec) Compress(dst, src []byte) ([]byte, error) {
+	return blockCompress(dst, src, c.Compressor, c.BufferSize)
+}
+
+func (c *BlockCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return blockUncompress(dst, src, c.Compressor, 0)
+}
+
+func (c *BlockCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return blockUncompress(dst, src, c.Compressor, limit)
+}
+
+func (c *BlockCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return newBlockReader(r, c.Compressor, c.BufferSize)
+}
+
+func (c *BlockCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return newBlockWriter(w, c.Compressor, c.BufferSize)
+}
+
+// WithOptions supports CodecOptions.BufferSize only.
+func (c *BlockCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	bufferSize, err := blockBufferSize(c.Compressor, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockCodec{Compressor: c.Compressor, BufferSize: bufferSize}, nil
+}
+
+// blockBufferSize validates opts for a codec built on compressor and returns
+// the buffer size to use, zero meaning the default.
+func blockBufferSize(compressor RawBlockCompressor, opts CodecOptions) (int, error) {
+	if opts.Level != 0 {
+		return 0, fmt.Errorf("unsupported compression level %d", opts.Level)
+	}
+	if opts.Strategy != DEFAULT_STRATEGY {
+		return 0, fmt.Errorf("unsupported compression strategy %d", opts.Strategy)
+	}
+	if _, err := blockMaxInputSize(compressor, opts.BufferSize); err != nil {
+		return 0, err
+	}
+	return opts.BufferSize, nil
+}
+
+// blockMaxInputSize returns how many uncompressed bytes go into one chunk.
+// Compressed, such a chunk takes at most bufferSize bytes.
+func blockMaxInputSize(compressor RawBlockCompressor, bufferSize int) (int, error) {
+	if bufferSize == 0 {
+		bufferSize = DEFAULT_BLOCK_BUFFER_SIZE
+	}
+	maxInputSize := bufferSize - compressor.CompressionOverhead(bufferSize)
+	if bufferSize < 0 || maxInputSize <= 0 {
+		return 0, fmt.Errorf("buffer size %d too small", bufferSize)
+	}
+	return maxInputSize, nil
+}
+
+// blockCompress frames src as a single block, split into chunks of at most
+// bufferSize minus the compression overhead uncompressed bytes.
+func blockCompress(dst, src []byte, compressor RawBlockCompressor, bufferSize int) ([]byte, error) {
+	maxInputSize, err := blockMaxInputSize(compressor, bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(src)))
+	dst = append(dst, header[:]...)
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxInputSize {
+			n = maxInputSize
+		}
+		lengthPos := len(dst)
+		dst = append(dst, header[:]...)
+		dst, err = compressor.CompressBlock(dst, src[:n])
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(dst[lengthPos:], uint32(len(dst)-lengthPos-4))
+		src = src[n:]
+	}
+	return dst, nil
+}
+
+// blockUncompress is the inverse of blockCompress, modelled after Hadoop's
+// BlockDecompressorStream. src may hold any number of framed blocks. The
+// declared block sizes are checked against limit before decompressing, but
+// not trusted otherwise: dst only grows as chunks are decompressed.
+func blockUncompress(dst, src []byte, compressor RawBlockCompressor, limit int) ([]byte, error) {
+	total := 0
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, fmt.Errorf("truncated block header")
+		}
+		originalSize := int(binary.BigEndian.Uint32(src))
+		src = src[4:]
+		if originalSize == 0 {
+			break // Hadoop treats an empty block as end of stream
+		}
+		total += originalSize
+		if limit > 0 && total > limit {
+			return nil, &DecompressionLimitError{Limit: limit}
+		}
+		start := len(dst)
+		for len(dst)-start < originalSize {
+			if len(src) < 4 {
+				return nil, fmt.Errorf("truncated chunk header")
+			}
+			chunkSize := int(binary.BigEndian.Uint32(src))
+			src = src[4:]
+			if chunkSize == 0 {
+				return nil, fmt.Errorf("empty chunk")
+			}
+			if chunkSize > len(src) {
+				return nil, fmt.Errorf("truncated chunk")
+			}
+			var err error
+			dst, err = compressor.UncompressBlock(dst, src[:chunkSize], originalSize-(len(dst)-start))
+			if err != nil {
+				return nil, err
+			}
+			src = src[chunkSize:]
+		}
+	}
+	return dst, nil
+}
+
+// blockReader is the streaming counterpart of blockUncompress. It hands out
+// every chunk as soon as it is decompressed, rather than whole blocks, whose
+// size is only limited by the header. Chunks larger than the buffer size, in
+// either form, are rejected, as the writer cannot have produced them. This
+// bounds the memory used for a stream of any content.
+type blockReader struct {
+	reader     io.Reader
+	compressor RawBlockCompressor
+	bufferSize int
+	remaining  int // bytes of the current block not decompressed yet
+	chunk      []byte
+	buf        []byte
+	compressed []byte
+	eof        bool
+}
+
+func newBlockReader(r io.Reader, compressor RawBlockCompressor, bufferSize int) (*blockReader, error) {
+	if _, err := blockMaxInputSize(compressor, bufferSize); err != nil {
+		return nil, err
+	}
+	if bufferSize == 0 {
+		bufferSize = DEFAULT_BLOCK_BUFFER_SIZE
+	}
+	return &blockReader{reader: r, compressor: compressor, bufferSize: bufferSize}, nil
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// readChunk decompresses the next chunk, after reading the header of the
+// next block if the current one is complete.
+func (r *blockReader) readChunk() error {
+	var header [4]byte
+	if r.remaining == 0 {
+		if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+			if err == io.EOF {
+				r.eof = true
+				return nil
+			}
+			return err
+		}
+		r.remaining = int(binary.BigEndian.Uint32(header[:]))
+		if r.remaining == 0 {
+			r.eof = true // Hadoop treats an empty block as end of stream
+			return nil
+		}
+	}
+
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[:]))
+	if chunkSize == 0 {
+		return fmt.Errorf("empty chunk")
+	}
+	if chunkSize > r.bufferSize {
+		return fmt.Errorf("chunk of %d bytes exceeds buffer size %d", chunkSize, r.bufferSize)
+	}
+	if cap(r.compressed) < chunkSize {
+		r.compressed = make([]byte, chunkSize)
+	}
+	r.compressed = r.compressed[:chunkSize]
+	if _, err := io.ReadFull(r.reader, r.compressed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	maxSize := r.remaining
+	if maxSize > r.bufferSize {
+		maxSize = r.bufferSize
+	}
+	var err error
+	r.buf, err = r.compressor.UncompressBlock(r.buf[:0], r.compressed, maxSize)
+	if err != nil {
+		return err
+	}
+	r.remaining -= len(r.buf)
+	r.chunk = r.buf
+	return nil
+}
+
+func (r *blockReader) Close() error {
+	return nil
+}
+
+// blockWriter is the streaming counterpart of blockCompress. Every
+// maxInputSize bytes of input become one framed block.
+type blockWriter struct {
+	writer       io.Writer
+	compressor   RawBlockCompressor
+	maxInputSize int
+	buf          []byte
+	compressed   []byte
+	err          error
+	closed       bool
+}
+
+func newBlockWriter(w io.Writer, compressor RawBlockCompressor, bufferSize int) (*blockWriter, error) {
+	maxInputSize, err := blockMaxInputSize(compressor, bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &blockWriter{writer: w, compressor: compressor, maxInputSize: maxInputSize}, nil
+}
+
+func (w *blockWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fmt.Errorf("write to closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := w.maxInputSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.maxInputSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *blockWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(w.buf)))
+	compressed := append(w.compressed[:0], header[:]...)
+	compressed = append(compressed, header[:]...)
+	compressed, err := w.compressor.CompressBlock(compressed, w.buf)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	binary.BigEndian.PutUint32(compressed[4:], uint32(len(compressed)-8))
+	w.compressed = compressed
+	if _, err := w.writer.Write(compressed); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *blockWriter) Close() error {
+	if w.err != nil || w.closed {
+		return w.err
+	}
+	w.closed = true
+	return w.flush()
+}
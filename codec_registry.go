@@ -0,0 +1,218 @@
+package hadoop
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CodecInfo describes a registered codec. ClassName is the Java class name
+// written to and read from SequenceFile headers. Besides by ClassName, the
+// codec can be looked up case-insensitively by its simple class name, by the
+// simple class name without the "Codec" suffix, and by any of Aliases.
+// Extension is the default file name extension, including the leading dot.
+type CodecInfo struct {
+	ClassName string
+	Aliases   []string
+	Extension string
+	Codec     Codec
+}
+
+type codecRegistry struct {
+	mutex       sync.RWMutex
+	byClassName map[string]*CodecInfo
+	byAlias     map[string]*CodecInfo
+	codecs      []*CodecInfo
+}
+
+var codecs = newCodecRegistry([]CodecInfo{
+	{ClassName: "org.apache.hadoop.io.compress.DefaultCodec", Aliases: []string{"deflate", "zlib"}, Extension: ".deflate", Codec: &ZlibCodec{}},
+	{ClassName: "org.apache.hadoop.io.compress.GzipCodec", Extension: ".gz", Codec: &GzipCodec{}},
+	{ClassName: "org.apache.hadoop.io.compress.BZip2Codec", Extension: ".bz2", Codec: &Bzip2Codec{}},
+	{ClassName: "org.apache.hadoop.io.compress.Lz4Codec", Extension: ".lz4", Codec: &Lz4Codec{}},
+	{ClassName: "org.apache.hadoop.io.compress.SnappyCodec", Extension: ".snappy", Codec: &SnappyCodec{}},
+	{ClassName: "org.apache.hadoop.io.compress.ZStandardCodec", Aliases: []string{"zstd"}, Extension: ".zst", Codec: &ZStandardCodec{}},
+	{ClassName: "com.hadoop.compression.lzo.LzoCodec", Extension: ".lzo_deflate", Codec: &LzoCodec{}},
+	{ClassName: "com.hadoop.compression.lzo.LzopCodec", Extension: ".lzo", Codec: &LzopCodec{}},
+})
+
+func newCodecRegistry(infos []CodecInfo) *codecRegistry {
+	registry := &codecRegistry{
+		byClassName: map[string]*CodecInfo{},
+		byAlias:     map[string]*CodecInfo{},
+	}
+	for _, info := range infos {
+		if err := registry.register(info, false); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+func (self *codecRegistry) register(info CodecInfo, override bool) error {
+	if info.ClassName == "" {
+		return fmt.Errorf("codec class name must not be empty")
+	}
+	if info.Codec == nil {
+		return fmt.Errorf("codec %s must not be nil", info.ClassName)
+	}
+	if info.Extension != "" && !strings.HasPrefix(info.Extension, ".") {
+		return fmt.Errorf("codec extension %q must start with a dot", info.Extension)
+	}
+	info.Aliases = append([]string(nil), info.Aliases...)
+	aliases := codecAliases(&info)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// aliases and extensions of other codecs are only taken over on request
+	var others []*CodecInfo
+	for _, alias := range aliases {
+		if registered, ok := self.byAlias[strings.ToLower(alias)]; ok && registered.ClassName != info.ClassName {
+			if !override {
+				return fmt.Errorf("codec alias %s is already registered for %s", alias, registered.ClassName)
+			}
+			others = append(others, registered)
+		}
+	}
+	for _, registered := range self.codecs {
+		if info.Extension != "" && registered.Extension == info.Extension && registered.ClassName != info.ClassName {
+			if !override {
+				return fmt.Errorf("codec extension %s is already registered for %s", info.Extension, registered.ClassName)
+			}
+			others = append(others, registered)
+		}
+	}
+	for _, registered := range others {
+		if registered.Extension == info.Extension {
+			registered.Extension = ""
+		}
+		kept := registered.Aliases[:0:0]
+		for _, alias := range registered.Aliases {
+			if !containsFold(aliases, alias) {
+				kept = append(kept, alias)
+			}
+		}
+		registered.Aliases = kept
+	}
+
+	// re-registering a class name replaces the previous registration
+	if previous, ok := self.byClassName[info.ClassName]; ok {
+		for i, registered := range self.codecs {
+			if registered == previous {
+				self.codecs = append(self.codecs[:i], self.codecs[i+1:]...)
+				break
+			}
+		}
+		for alias, registered := range self.byAlias {
+			if registered == previous {
+				delete(self.byAlias, alias)
+			}
+		}
+	}
+	self.codecs = append(self.codecs, &info)
+	self.byClassName[info.ClassName] = &info
+	for _, alias := range aliases {
+		self.byAlias[strings.ToLower(alias)] = &info
+	}
+	return nil
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// codecAliases returns the names other than the class name that info can be
+// looked up by, like CompressionCodecFactory.getCodecByName does.
+func codecAliases(info *CodecInfo) []string {
+	simpleName := info.ClassName[strings.LastIndex(info.ClassName, ".")+1:]
+	aliases := []string{simpleName}
+	if alias := strings.TrimSuffix(simpleName, "Codec"); alias != "" && alias != simpleName {
+		aliases = append(aliases, alias)
+	}
+	return append(aliases, info.Aliases...)
+}
+
+func (self *codecRegistry) lookup(name string) (CodecInfo, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if info, ok := self.byClassName[name]; ok {
+		return *info, true
+	}
+	if info, ok := self.byAlias[strings.ToLower(name)]; ok {
+		return *info, true
+	}
+	return CodecInfo{}, false
+}
+
+func (self *codecRegistry) lookupByFileName(fileName string) (CodecInfo, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	var found *CodecInfo
+	for _, info := range self.codecs {
+		if info.Extension == "" || !strings.HasSuffix(fileName, info.Extension) {
+			continue
+		}
+		if found == nil || len(info.Extension) > len(found.Extension) {
+			found = info
+		}
+	}
+	if found == nil {
+		return CodecInfo{}, false
+	}
+	return *found, true
+}
+
+func (self *codecRegistry) list() []CodecInfo {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	infos := make([]CodecInfo, 0, len(self.codecs))
+	for _, info := range self.codecs {
+		infos = append(infos, *info)
+	}
+	return infos
+}
+
+// RegisterCodec makes a codec available to SequenceFile readers and writers
+// and to the lookup functions. Registering a class name again replaces the
+// earlier registration, including its aliases and extension. An alias or
+// extension already taken by a codec of another class name is an error. It
+// is safe to call concurrently with lookups.
+func RegisterCodec(info CodecInfo) error {
+	return codecs.register(info, false)
+}
+
+// RegisterCodecOverride is RegisterCodec, except that aliases and the
+// extension already taken by codecs of other class names move over to info,
+// e.g. to read ".gz" files with a different gzip implementation.
+func RegisterCodecOverride(info CodecInfo) error {
+	return codecs.register(info, true)
+}
+
+// LookupCodec finds a codec by class name or alias, e.g.
+// "org.apache.hadoop.io.compress.GzipCodec", "GzipCodec" or "gzip".
+func LookupCodec(name string) (CodecInfo, bool) {
+	if info, ok := codecs.lookup(name); ok {
+		return info, true
+	}
+	if codec, ok := Codecs[name]; ok {
+		return CodecInfo{ClassName: name, Codec: codec}, true
+	}
+	return CodecInfo{}, false
+}
+
+// LookupCodecByFileName finds the codec whose extension fileName ends with,
+// preferring the longest matching extension like CompressionCodecFactory.
+func LookupCodecByFileName(fileName string) (CodecInfo, bool) {
+	return codecs.lookupByFileName(fileName)
+}
+
+// RegisteredCodecs returns all registered codecs in registration order.
+func RegisteredCodecs() []CodecInfo {
+	return codecs.list()
+}
@@ -0,0 +1,289 @@
+package hadoop
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// CODEC_SELECTION_METADATA_KEY is the SequenceFile metadata key holding the
+// class name of the codec picked by CodecSelection. With RecordSamples, the
+// measurements of each candidate are stored under this key followed by "."
+// and the class name.
+const CODEC_SELECTION_METADATA_KEY = "go-hadoop-io.codec.selection"
+
+// hadoopCodecs are the default candidates: the codecs stock Hadoop reads.
+var hadoopCodecs = []string{
+	"org.apache.hadoop.io.compress.DefaultCodec",
+	"org.apache.hadoop.io.compress.GzipCodec",
+	"org.apache.hadoop.io.compress.BZip2Codec",
+	"org.apache.hadoop.io.compress.Lz4Codec",
+	"org.apache.hadoop.io.compress.SnappyCodec",
+	"org.apache.hadoop.io.compress.ZStandardCodec",
+}
+
+// CodecSelection makes a SequenceFileWriter pick its codec by compressing the
+// first blocks of the file with every candidate. The blocks are held back,
+// and the file header is only written once the codec is chosen.
+type CodecSelection struct {
+	// Candidates are codec class names or aliases understood by
+	// LookupCodec. Empty means the codecs built into Hadoop: deflate, gzip,
+	// bzip2, lz4, snappy and zstd. The candidates are used with their
+	// default options.
+	Candidates []string
+
+	// SampleBlocks is the number of blocks compressed with every candidate.
+	// Defaults to 1.
+	SampleBlocks int
+
+	// Policy picks the codec from the measurements. Defaults to
+	// MaxRatioPolicy(0).
+	Policy CodecPolicy
+
+	// RecordSamples also stores the measurements of every candidate in the
+	// file metadata. As timings differ from run to run, a file written with
+	// it is not reproducible byte for byte, even from identical input and
+	// sync marker. Without it, only policies weighing throughput make the
+	// output depend on timing, through the choice of codec.
+	RecordSamples bool
+}
+
+// CodecSample holds the measurements of one candidate codec on the sampled
+// blocks.
+type CodecSample struct {
+	Info             CodecInfo
+	UncompressedSize int64
+	CompressedSize   int64
+	CompressTime     time.Duration
+	UncompressTime   time.Duration
+}
+
+// Ratio returns the uncompressed size divided by the compressed size.
+func (s CodecSample) Ratio() float64 {
+	if s.CompressedSize == 0 {
+		return 0
+	}
+	return float64(s.UncompressedSize) / float64(s.CompressedSize)
+}
+
+// CompressThroughput returns the uncompressed MB compressed per second.
+func (s CodecSample) CompressThroughput() float64 {
+	return throughput(s.UncompressedSize, s.CompressTime)
+}
+
+// UncompressThroughput returns the uncompressed MB produced per second.
+func (s CodecSample) UncompressThroughput() float64 {
+	return throughput(s.UncompressedSize, s.UncompressTime)
+}
+
+func throughput(size int64, d time.Duration) float64 {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	return float64(size) / (1 << 20) / d.Seconds()
+}
+
+func (s CodecSample) String() string {
+	return fmt.Sprintf("ratio=%.3f compress=%.1fMB/s uncompress=%.1fMB/s", s.Ratio(), s.CompressThroughput(), s.UncompressThroughput())
+}
+
+// CodecPolicy returns the index of the sample of the codec to use. samples
+// is never empty.
+type CodecPolicy func(samples []CodecSample) (int, error)
+
+// MaxRatioPolicy picks the codec with the best ratio among those compressing
+// at least minThroughput MB/s. If no codec is fast enough, the fastest wins.
+func MaxRatioPolicy(minThroughput float64) CodecPolicy {
+	return func(samples []CodecSample) (int, error) {
+		best, fastest := -1, 0
+		for i, sample := range samples {
+			if sample.CompressThroughput() > samples[fastest].CompressThroughput() {
+				fastest = i
+			}
+			if sample.CompressThroughput() < minThroughput {
+				continue
+			}
+			if best < 0 || sample.Ratio() > samples[best].Ratio() {
+				best = i
+			}
+		}
+		if best < 0 {
+			return fastest, nil
+		}
+		return best, nil
+	}
+}
+
+// MaxThroughputPolicy picks the fastest compressing codec among those
+// reaching at least minRatio. If no codec compresses that well, the best
+// ratio wins.
+func MaxThroughputPolicy(minRatio float64) CodecPolicy {
+	return func(samples []CodecSample) (int, error) {
+		best, smallest := -1, 0
+		for i, sample := range samples {
+			if sample.Ratio() > samples[smallest].Ratio() {
+				smallest = i
+			}
+			if sample.Ratio() < minRatio {
+				continue
+			}
+			if best < 0 || sample.CompressThroughput() > samples[best].CompressThroughput() {
+				best = i
+			}
+		}
+		if best < 0 {
+			return smallest, nil
+		}
+		return best, nil
+	}
+}
+
+// codecSelector holds back the first blocks of a SequenceFileWriter until
+// the codec is chosen.
+type codecSelector struct {
+	candidates   []CodecInfo
+	sampleBlocks int
+	policy       CodecPolicy
+	fallback     CodecInfo // used if the file has no records
+	record       bool
+	blocks       []*sequenceFileWriterBlock
+}
+
+func newCodecSelector(selection *CodecSelection, fallback CodecInfo) (*codecSelector, error) {
+	selector := &codecSelector{
+		sampleBlocks: selection.SampleBlocks,
+		policy:       selection.Policy,
+		fallback:     fallback,
+		record:       selection.RecordSamples,
+	}
+	if selector.sampleBlocks < 0 {
+		return nil, fmt.Errorf("sample blocks must not be negative")
+	}
+	if selector.sampleBlocks == 0 {
+		selector.sampleBlocks = 1
+	}
+	if selector.policy == nil {
+		selector.policy = MaxRatioPolicy(0)
+	}
+	names := selection.Candidates
+	if len(names) == 0 {
+		names = hadoopCodecs
+	}
+	for _, name := range names {
+		info, ok := LookupCodec(name)
+		if !ok {
+			return nil, fmt.Errorf("unsupported codec %s", name)
+		}
+		selector.candidates = append(selector.candidates, info)
+	}
+	if len(selector.candidates) == 0 {
+		return nil, fmt.Errorf("no candidate codecs")
+	}
+	return selector, nil
+}
+
+// add holds back a finished block and reports whether enough blocks have
+// been sampled.
+func (self *codecSelector) add(block *sequenceFileWriterBlock) bool {
+	self.blocks = append(self.blocks, block)
+	return len(self.blocks) >= self.sampleBlocks
+}
+
+// sample compresses the held back blocks with every candidate. The first
+// block is run through each codec once untimed, so that setting up encoders
+// and filling pools does not count against codecs that need it.
+func (self *codecSelector) sample() ([]CodecSample, error) {
+	samples := make([]CodecSample, 0, len(self.candidates))
+	var compressed, uncompressed []byte
+	for _, info := range self.candidates {
+		for _, buffer := range blockBuffers(self.blocks[0]) {
+			var err error
+			compressed, err = info.Codec.Compress(compressed[:0], buffer.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("codec %s: %v", info.ClassName, err)
+			}
+			uncompressed, err = info.Codec.Uncompress(uncompressed[:0], compressed)
+			if err != nil {
+				return nil, fmt.Errorf("codec %s: %v", info.ClassName, err)
+			}
+		}
+
+		sample := CodecSample{Info: info}
+		for _, block := range self.blocks {
+			for _, buffer := range blockBuffers(block) {
+				var err error
+				start := time.Now()
+				compressed, err = info.Codec.Compress(compressed[:0], buffer.Bytes())
+				if err != nil {
+					return nil, fmt.Errorf("codec %s: %v", info.ClassName, err)
+				}
+				sample.CompressTime += time.Since(start)
+
+				start = time.Now()
+				uncompressed, err = info.Codec.Uncompress(uncompressed[:0], compressed)
+				if err != nil {
+					return nil, fmt.Errorf("codec %s: %v", info.ClassName, err)
+				}
+				sample.UncompressTime += time.Since(start)
+				if !bytes.Equal(uncompressed, buffer.Bytes()) {
+					return nil, fmt.Errorf("codec %s: round trip mismatch", info.ClassName)
+				}
+				sample.UncompressedSize += int64(buffer.Len())
+				sample.CompressedSize += int64(len(compressed))
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func blockBuffers(block *sequenceFileWriterBlock) [4]*bytes.Buffer {
+	return [...]*bytes.Buffer{
+		&block.keyLenBuffer,
+		&block.keyBuffer,
+		&block.valueLenBuffer,
+		&block.valueBuffer,
+	}
+}
+
+// choose runs the policy on the held back blocks. It returns the chosen
+// codec and the metadata recording the decision.
+func (self *codecSelector) choose() (CodecInfo, map[string]string, error) {
+	if len(self.blocks) == 0 {
+		return self.fallback, map[string]string{
+			CODEC_SELECTION_METADATA_KEY: self.fallback.ClassName,
+		}, nil
+	}
+	samples, err := self.sample()
+	if err != nil {
+		return CodecInfo{}, nil, err
+	}
+	chosen, err := self.policy(samples)
+	if err != nil {
+		return CodecInfo{}, nil, err
+	}
+	if chosen < 0 || chosen >= len(samples) {
+		return CodecInfo{}, nil, fmt.Errorf("codec policy returned bad index %d", chosen)
+	}
+	metadata := map[string]string{
+		CODEC_SELECTION_METADATA_KEY: samples[chosen].Info.ClassName,
+	}
+	if self.record {
+		for _, sample := range samples {
+			metadata[CODEC_SELECTION_METADATA_KEY+"."+sample.Info.ClassName] = sample.String()
+		}
+	}
+	return samples[chosen].Info, metadata, nil
+}
+
+// sortedKeys returns the keys of m in order, as the TreeMap of Hadoop's
+// SequenceFile.Metadata writes them.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,263 @@
+package hadoop
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// StreamCodec mirrors CompressionCodec.createInputStream and
+// createOutputStream: it wraps a reader or writer with (de)compression.
+// Closing the returned reader or writer does not close the wrapped one.
+type StreamCodec interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// CompressionCodec is implemented by codecs that work on both whole buffers
+// and streams. All built-in codecs implement it.
+type CompressionCodec interface {
+	Codec
+	StreamCodec
+}
+
+var (
+	_ CompressionCodec = &ZlibCodec{}
+	_ CompressionCodec = &GzipCodec{}
+	_ CompressionCodec = &Bzip2Codec{}
+	_ CompressionCodec = &Lz4Codec{}
+	_ CompressionCodec = &SnappyCodec{}
+	_ CompressionCodec = &ZStandardCodec{}
+	_ CompressionCodec = &LzoCodec{}
+	_ CompressionCodec = &LzopCodec{}
+)
+
+// AsCompressionCodec returns codec itself if it supports streams. Otherwise
+// the streams of the returned codec buffer everything and hand it to the
+// buffer-based methods of codec in one go.
+func AsCompressionCodec(codec Codec) CompressionCodec {
+	if c, ok := codec.(CompressionCodec); ok {
+		return c
+	}
+	return &bufferingCodec{Codec: codec}
+}
+
+// FromStreamCodec turns a stream-only codec into a CompressionCodec whose
+// buffer-based methods run the buffers through the streams.
+func FromStreamCodec(codec StreamCodec) CompressionCodec {
+	if c, ok := codec.(CompressionCodec); ok {
+		return c
+	}
+	return &streamingCodec{StreamCodec: codec}
+}
+
+// NewReaderLimit is like codec.NewReader, but the returned reader fails with
+// a *DecompressionLimitError once more than limit bytes were decompressed.
+// Zero means no limit. The built-in codecs decompress in pieces of bounded
+// size, so the limit also bounds the memory a stream of any content takes.
+func NewReaderLimit(codec StreamCodec, r io.Reader, limit int) (io.ReadCloser, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("decompression limit must not be negative")
+	}
+	if limit == 0 {
+		return codec.NewReader(r)
+	}
+	if buffering, ok := codec.(*bufferingCodec); ok {
+		// decompresses everything up front
+		return buffering.newReaderLimit(r, limit)
+	}
+	reader, err := codec.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &limitReader{ReadCloser: reader, limit: limit}, nil
+}
+
+// limitReader counts the bytes read through it. It reads one byte past the
+// limit, so that exactly limit bytes of output are still accepted.
+type limitReader struct {
+	io.ReadCloser
+	limit int
+	n     int
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.n > r.limit {
+		return 0, &DecompressionLimitError{Limit: r.limit}
+	}
+	if len(p) > r.limit-r.n+1 {
+		p = p[:r.limit-r.n+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n += n
+	if r.n > r.limit {
+		return n - (r.n - r.limit), &DecompressionLimitError{Limit: r.limit}
+	}
+	return n, err
+}
+
+type bufferingCodec struct {
+	Codec
+}
+
+func (c *bufferingCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return c.newReaderLimit(r, 0)
+}
+
+func (c *bufferingCodec) newReaderLimit(r io.Reader, limit int) (io.ReadCloser, error) {
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	uncompressed, err := UncompressLimit(c.Codec, nil, compressed, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(uncompressed)), nil
+}
+
+func (c *bufferingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &bufferingWriter{codec: c.Codec, writer: w}, nil
+}
+
+type bufferingWriter struct {
+	codec  Codec
+	writer io.Writer
+	buf    []byte
+	closed bool
+}
+
+func (w *bufferingWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("write to closed writer")
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *bufferingWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	compressed, err := w.codec.Compress(nil, w.buf)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.Write(compressed)
+	return err
+}
+
+type streamingCodec struct {
+	StreamCodec
+}
+
+func (c *streamingCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := &appendWriter{buf: dst}
+	writer, err := c.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.buf, nil
+}
+
+func (c *streamingCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return c.UncompressLimit(dst, src, 0)
+}
+
+func (c *streamingCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	reader, err := c.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readAllInto(dst, reader, limit)
+}
+
+func (c *ZlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+func (c *ZlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, c.compressionLevel())
+}
+
+func (c *GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (c *GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.compressionLevel())
+}
+
+func (c *Bzip2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(r)), nil
+}
+
+func (c *Bzip2Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	blockSize := c.blockSize
+	if blockSize == 0 {
+		blockSize = BZIP2_DEFAULT_BLOCK_SIZE
+	}
+	return newBzip2Writer(w, blockSize), nil
+}
+
+func (c *ZStandardCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func (c *ZStandardCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.level
+	if level == 0 {
+		level = ZSTD_DEFAULT_LEVEL
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+}
+
+func (c *Lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return newBlockReader(r, lz4Compressor{}, c.compressionBufferSize())
+}
+
+func (c *Lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return newBlockWriter(w, lz4Compressor{}, c.compressionBufferSize())
+}
+
+func (c *SnappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return newBlockReader(r, snappyCompressor{}, c.compressionBufferSize())
+}
+
+func (c *SnappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return newBlockWriter(w, snappyCompressor{}, c.compressionBufferSize())
+}
+
+func (c *LzoCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return newBlockReader(r, lzoCompressor{}, c.compressionBufferSize())
+}
+
+func (c *LzoCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return newBlockWriter(w, lzoCompressor{}, c.compressionBufferSize())
+}
+
+func (c *LzopCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&lzopReader{reader: r}), nil
+}
+
+func (c *LzopCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return newLzopWriter(w)
+}
@@ -0,0 +1,729 @@
+package hadoop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func genCompressibleData(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		key, _ := genTestData(i + 2)
+		buf.WriteString(key[:len(key)%64])
+		buf.WriteString("the quick brown fox jumps over the lazy dog ")
+	}
+	return buf.Bytes()[:size]
+}
+
+func testCodecRoundTrip(t *testing.T, codec Codec, data []byte) {
+	assert := assert.New(t)
+	compressed, err := codec.Compress(nil, data)
+	if !assert.NoError(err) {
+		return
+	}
+	uncompressed, err := codec.Uncompress(nil, compressed)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(len(data), len(uncompressed))
+	assert.True(bytes.Equal(data, uncompressed))
+}
+
+func TestZlibCodecOptions(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(1 << 20)
+
+	var sizes []int
+	for _, opts := range []CodecOptions{
+		{Level: 1},
+		{Level: 9},
+		{Strategy: HUFFMAN_ONLY},
+	} {
+		codec, err := ConfigureCodec(Codecs["org.apache.hadoop.io.compress.DefaultCodec"], opts)
+		assert.NoError(err)
+		testCodecRoundTrip(t, codec, data)
+		compressed, err := codec.Compress(nil, data)
+		assert.NoError(err)
+		sizes = append(sizes, len(compressed))
+	}
+	assert.True(sizes[1] < sizes[0])
+	assert.True(sizes[0] < sizes[2])
+	assert.Equal(&ZlibCodec{}, Codecs["org.apache.hadoop.io.compress.DefaultCodec"])
+
+	// NO_COMPRESSION stores the data in deflate blocks
+	for _, codec := range []Codec{&ZlibCodec{}, &GzipCodec{}} {
+		stored, err := ConfigureCodec(codec, CodecOptions{Level: NO_COMPRESSION})
+		assert.NoError(err)
+		testCodecRoundTrip(t, stored, data)
+		compressed, err := stored.Compress(nil, data)
+		assert.NoError(err)
+		assert.True(len(compressed) > len(data), "%T", codec)
+		var buf bytes.Buffer
+		writer, err := stored.(CompressionCodec).NewWriter(&buf)
+		assert.NoError(err)
+		writer.Write(data)
+		assert.NoError(writer.Close())
+		assert.Equal(compressed, buf.Bytes())
+	}
+	_, err := ConfigureCodec(&ZlibCodec{}, CodecOptions{Level: -2})
+	assert.Error(err)
+
+	_, err = ConfigureCodec(&ZlibCodec{}, CodecOptions{Level: 10})
+	assert.Error(err)
+	_, err = ConfigureCodec(&ZlibCodec{}, CodecOptions{Strategy: RLE})
+	assert.Error(err)
+}
+
+func TestLz4Codec(t *testing.T) {
+	codec := &Lz4Codec{}
+	for _, size := range []int{0, 1, 12, 13, 100, 65536, 1 << 20} {
+		testCodecRoundTrip(t, codec, genCompressibleData(size))
+	}
+	random, _ := genTestData(0)
+	testCodecRoundTrip(t, codec, []byte(random))
+	testCodecRoundTrip(t, codec, make([]byte, 3<<20))
+}
+
+func TestLz4CodecUncompress(t *testing.T) {
+	assert := assert.New(t)
+	framed := []byte{
+		0x00, 0x00, 0x00, 0x0d, // uncompressed length
+		0x00, 0x00, 0x00, 0x08, // compressed chunk length
+		0x35, 'a', 'b', 'c', 0x03, 0x00, // "abc", then 9 bytes at offset 3
+		0x10, 'x', // last literals
+	}
+	uncompressed, err := (&Lz4Codec{}).Uncompress(nil, framed)
+	assert.NoError(err)
+	assert.Equal("abcabcabcabcx", string(uncompressed))
+
+	framed[12] = 0x04 // offset beyond the start of the output
+	_, err = (&Lz4Codec{}).Uncompress(nil, framed)
+	assert.Error(err)
+}
+
+func TestSnappyCodec(t *testing.T) {
+	codec := &SnappyCodec{}
+	for _, size := range []int{0, 1, 100, 65536, 1 << 20} {
+		testCodecRoundTrip(t, codec, genCompressibleData(size))
+	}
+	random, _ := genTestData(0)
+	testCodecRoundTrip(t, codec, []byte(random))
+}
+
+func TestSnappyCodecUncompress(t *testing.T) {
+	assert := assert.New(t)
+	framed := []byte{
+		0x00, 0x00, 0x00, 0x0d, // uncompressed length
+		0x00, 0x00, 0x00, 0x09, // compressed chunk length
+		0x0d,                // snappy uncompressed length
+		0x08, 'a', 'b', 'c', // literal "abc"
+		0x15, 0x03, // copy 9 bytes at offset 3
+		0x00, 'x', // literal "x"
+		0x00, 0x00, 0x00, 0x00, // end of stream
+	}
+	uncompressed, err := (&SnappyCodec{}).Uncompress(nil, framed)
+	assert.NoError(err)
+	assert.Equal("abcabcabcabcx", string(uncompressed))
+}
+
+func TestZStandardCodec(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(1 << 20)
+	for _, size := range []int{0, 1, 100, 65536} {
+		testCodecRoundTrip(t, &ZStandardCodec{}, genCompressibleData(size))
+	}
+
+	fast, err := ConfigureCodec(&ZStandardCodec{}, CodecOptions{Level: 1})
+	assert.NoError(err)
+	best, err := ConfigureCodec(&ZStandardCodec{}, CodecOptions{Level: 19})
+	assert.NoError(err)
+	testCodecRoundTrip(t, fast, data)
+	testCodecRoundTrip(t, best, data)
+	fastCompressed, _ := fast.Compress(nil, data)
+	bestCompressed, _ := best.Compress(nil, data)
+	assert.True(len(bestCompressed) < len(fastCompressed))
+
+	// levels map onto the four levels of the encoder
+	sizes := map[int]int{}
+	for _, level := range []int{1, 2, 3, 5, 6, 9, 10, 22} {
+		codec, err := ConfigureCodec(&ZStandardCodec{}, CodecOptions{Level: level})
+		assert.NoError(err)
+		compressed, _ := codec.Compress(nil, data)
+		sizes[level] = len(compressed)
+	}
+	assert.Equal(sizes[1], sizes[2])
+	assert.Equal(sizes[3], sizes[5])
+	assert.Equal(sizes[6], sizes[9])
+	assert.Equal(sizes[10], sizes[22])
+	assert.NotEqual(sizes[2], sizes[3])
+	assert.NotEqual(sizes[5], sizes[6])
+	assert.NotEqual(sizes[9], sizes[10])
+
+	// Two concatenated frames, as written by a stream flushed in between.
+	first, _ := fast.Compress(nil, []byte("hello, "))
+	second, _ := fast.Compress(first, []byte("world"))
+	uncompressed, err := (&ZStandardCodec{}).Uncompress(nil, second)
+	assert.NoError(err)
+	assert.Equal("hello, world", string(uncompressed))
+
+	_, err = ConfigureCodec(&ZStandardCodec{}, CodecOptions{Level: 23})
+	assert.Error(err)
+}
+
+func TestGzipCodec(t *testing.T) {
+	assert := assert.New(t)
+	for _, size := range []int{0, 1, 100, 1 << 20} {
+		testCodecRoundTrip(t, &GzipCodec{}, genCompressibleData(size))
+	}
+	codec, err := ConfigureCodec(&GzipCodec{}, CodecOptions{Level: 9})
+	assert.NoError(err)
+	testCodecRoundTrip(t, codec, genCompressibleData(1<<16))
+
+	// Multiple gzip members, e.g. from concatenated .gz files.
+	first, _ := (&GzipCodec{}).Compress(nil, []byte("hello, "))
+	both, _ := (&GzipCodec{}).Compress(first, []byte("world"))
+	uncompressed, err := (&GzipCodec{}).Uncompress(nil, both)
+	assert.NoError(err)
+	assert.Equal("hello, world", string(uncompressed))
+}
+
+func TestBzip2Codec(t *testing.T) {
+	assert := assert.New(t)
+	codec := &Bzip2Codec{}
+	for _, size := range []int{0, 1, 100, 65536, 1 << 20} {
+		testCodecRoundTrip(t, codec, genCompressibleData(size))
+	}
+	random, _ := genTestData(0)
+	testCodecRoundTrip(t, codec, []byte(random))
+	testCodecRoundTrip(t, codec, make([]byte, 1<<20))
+	testCodecRoundTrip(t, codec, bytes.Repeat([]byte("ab"), 1<<18))
+
+	// Small blocks split the input into several bzip2 blocks.
+	small, err := ConfigureCodec(codec, CodecOptions{Level: 1})
+	assert.NoError(err)
+	testCodecRoundTrip(t, small, genCompressibleData(1<<20))
+	compressed, _ := small.Compress(nil, genCompressibleData(1<<20))
+	assert.Equal("BZh1", string(compressed[:4]))
+	assert.True(bytes.Count(compressed, []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}) > 1)
+}
+
+func TestLzoCodec(t *testing.T) {
+	for _, codec := range []Codec{&LzoCodec{}, &LzopCodec{}} {
+		for _, size := range []int{0, 1, 3, 4, 100, 239, 65536, 1 << 20} {
+			testCodecRoundTrip(t, codec, genCompressibleData(size))
+		}
+		random, _ := genTestData(0)
+		testCodecRoundTrip(t, codec, []byte(random))
+		testCodecRoundTrip(t, codec, make([]byte, 1<<20))
+		testCodecRoundTrip(t, codec, bytes.Repeat([]byte("ab"), 1<<18))
+	}
+}
+
+func TestLzoUncompressBlock(t *testing.T) {
+	assert := assert.New(t)
+	block := []byte{
+		0x15, 'a', 'b', 'c', 'd', // 4 literals at the start of the stream
+		0xec, 0x00, // M2 match: 8 bytes at offset 4
+		0x11, 0x00, 0x00, // end of stream
+	}
+	uncompressed, err := lzoUncompressBlock(nil, block, 100)
+	assert.NoError(err)
+	assert.Equal("abcdabcdabcd", string(uncompressed))
+
+	_, err = lzoUncompressBlock(nil, block, 10)
+	assert.Error(err)
+	_, err = lzoUncompressBlock(nil, block[:7], 100)
+	assert.Error(err)
+}
+
+func TestLzopCodecChecksum(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(1000)
+	compressed, err := (&LzopCodec{}).Compress(nil, data)
+	assert.NoError(err)
+	assert.Equal(LZOP_MAGIC, compressed[:len(LZOP_MAGIC)])
+	compressed[len(compressed)-10] ^= 0xff
+	_, err = (&LzopCodec{}).Uncompress(nil, compressed)
+	assert.Error(err)
+}
+
+func testStreamRoundTrip(t *testing.T, codec CompressionCodec, data []byte) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	writer, err := codec.NewWriter(&buf)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := writer.Write(data[i:end])
+		assert.NoError(err)
+	}
+	assert.NoError(writer.Close())
+
+	// streams must be compatible with the buffer-based methods
+	uncompressed, err := codec.Uncompress(nil, buf.Bytes())
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, uncompressed))
+
+	compressed, err := codec.Compress(nil, data)
+	assert.NoError(err)
+	reader, err := codec.NewReader(bytes.NewReader(compressed))
+	if !assert.NoError(err) {
+		return
+	}
+	uncompressed, err = ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.NoError(reader.Close())
+	assert.True(bytes.Equal(data, uncompressed))
+}
+
+func TestStreamCodec(t *testing.T) {
+	data := genCompressibleData(1 << 20)
+	for name, codec := range Codecs {
+		t.Run(name, func(t *testing.T) {
+			testStreamRoundTrip(t, AsCompressionCodec(codec), data)
+		})
+	}
+}
+
+type bufferOnlyCodec struct {
+	codec Codec
+}
+
+func (c *bufferOnlyCodec) Compress(dst, src []byte) ([]byte, error) {
+	return c.codec.Compress(dst, src)
+}
+
+func (c *bufferOnlyCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return c.codec.Uncompress(dst, src)
+}
+
+type streamOnlyCodec struct {
+	codec StreamCodec
+}
+
+func (c *streamOnlyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return c.codec.NewReader(r)
+}
+
+func (c *streamOnlyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return c.codec.NewWriter(w)
+}
+
+func TestStreamCodecAdapters(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(100000)
+
+	zlibCodec := &ZlibCodec{}
+	assert.Equal(zlibCodec, AsCompressionCodec(zlibCodec))
+	assert.Equal(zlibCodec, FromStreamCodec(zlibCodec))
+
+	testStreamRoundTrip(t, AsCompressionCodec(&bufferOnlyCodec{codec: zlibCodec}), data)
+	testStreamRoundTrip(t, FromStreamCodec(&streamOnlyCodec{codec: zlibCodec}), data)
+
+	compressed, err := FromStreamCodec(&streamOnlyCodec{codec: &GzipCodec{}}).Compress([]byte("prefix"), data)
+	assert.NoError(err)
+	assert.Equal([]byte("prefix"), compressed[:6])
+	uncompressed, err := (&GzipCodec{}).Uncompress(nil, compressed[6:])
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, uncompressed))
+}
+
+func TestLookupCodec(t *testing.T) {
+	assert := assert.New(t)
+	for _, name := range []string{"org.apache.hadoop.io.compress.DefaultCodec", "DefaultCodec", "default", "deflate"} {
+		info, ok := LookupCodec(name)
+		assert.True(ok, name)
+		assert.Equal("org.apache.hadoop.io.compress.DefaultCodec", info.ClassName)
+		assert.Equal(&ZlibCodec{}, info.Codec)
+	}
+	for name, className := range map[string]string{
+		"gzip":        "org.apache.hadoop.io.compress.GzipCodec",
+		"BZip2":       "org.apache.hadoop.io.compress.BZip2Codec",
+		"lz4":         "org.apache.hadoop.io.compress.Lz4Codec",
+		"snappy":      "org.apache.hadoop.io.compress.SnappyCodec",
+		"zstd":        "org.apache.hadoop.io.compress.ZStandardCodec",
+		"lzo":         "com.hadoop.compression.lzo.LzoCodec",
+		"LzopCodec":   "com.hadoop.compression.lzo.LzopCodec",
+		"ZStandard":   "org.apache.hadoop.io.compress.ZStandardCodec",
+		"gzipcodec":   "org.apache.hadoop.io.compress.GzipCodec",
+		"SnappyCodec": "org.apache.hadoop.io.compress.SnappyCodec",
+	} {
+		info, ok := LookupCodec(name)
+		assert.True(ok, name)
+		assert.Equal(className, info.ClassName, name)
+	}
+	_, ok := LookupCodec("org.apache.hadoop.io.compress.gzipcodec")
+	assert.False(ok)
+	_, ok = LookupCodec("brotli")
+	assert.False(ok)
+}
+
+func TestLookupCodecByFileName(t *testing.T) {
+	assert := assert.New(t)
+	for fileName, className := range map[string]string{
+		"part-00000.gz":     "org.apache.hadoop.io.compress.GzipCodec",
+		"/tmp/data.deflate": "org.apache.hadoop.io.compress.DefaultCodec",
+		"x.bz2":             "org.apache.hadoop.io.compress.BZip2Codec",
+		"x.zst":             "org.apache.hadoop.io.compress.ZStandardCodec",
+		"x.lzo":             "com.hadoop.compression.lzo.LzopCodec",
+		"x.lzo_deflate":     "com.hadoop.compression.lzo.LzoCodec",
+		"x.snappy":          "org.apache.hadoop.io.compress.SnappyCodec",
+		"x.lz4":             "org.apache.hadoop.io.compress.Lz4Codec",
+	} {
+		info, ok := LookupCodecByFileName(fileName)
+		assert.True(ok, fileName)
+		assert.Equal(className, info.ClassName, fileName)
+	}
+	_, ok := LookupCodecByFileName("x.txt")
+	assert.False(ok)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	assert := assert.New(t)
+	registry := newCodecRegistry(RegisteredCodecs())
+	assert.NoError(registry.register(CodecInfo{ClassName: "com.example.FastCodec", Aliases: []string{"fast", "quick"}, Extension: ".gz.fast", Codec: &SnappyCodec{}}, false))
+
+	info, ok := registry.lookup("fast")
+	assert.True(ok)
+	assert.Equal("com.example.FastCodec", info.ClassName)
+	info, ok = registry.lookup("FastCodec")
+	assert.True(ok)
+	assert.Equal("com.example.FastCodec", info.ClassName)
+
+	// the longest extension wins
+	info, ok = registry.lookupByFileName("data.gz.fast")
+	assert.True(ok)
+	assert.Equal("com.example.FastCodec", info.ClassName)
+	info, ok = registry.lookupByFileName("data.gz")
+	assert.True(ok)
+	assert.Equal("org.apache.hadoop.io.compress.GzipCodec", info.ClassName)
+
+	// registering a class name again replaces the codec, aliases and extension
+	assert.NoError(registry.register(CodecInfo{ClassName: "com.example.FastCodec", Codec: &Lz4Codec{}}, false))
+	info, ok = registry.lookup("com.example.FastCodec")
+	assert.True(ok)
+	assert.Equal(&Lz4Codec{}, info.Codec)
+	assert.Equal(len(RegisteredCodecs())+1, len(registry.list()))
+	_, ok = registry.lookup("quick")
+	assert.False(ok)
+	_, ok = registry.lookupByFileName("data.gz.fast")
+	assert.False(ok)
+
+	// aliases and extensions of other codecs need an override
+	assert.EqualError(registry.register(CodecInfo{ClassName: "com.example.GzipCodec", Codec: &Lz4Codec{}}, false),
+		"codec alias GzipCodec is already registered for org.apache.hadoop.io.compress.GzipCodec")
+	assert.EqualError(registry.register(CodecInfo{ClassName: "com.example.MyCodec", Aliases: []string{"ZLIB"}, Codec: &Lz4Codec{}}, false),
+		"codec alias ZLIB is already registered for org.apache.hadoop.io.compress.DefaultCodec")
+	assert.EqualError(registry.register(CodecInfo{ClassName: "com.example.MyCodec", Extension: ".gz", Codec: &Lz4Codec{}}, false),
+		"codec extension .gz is already registered for org.apache.hadoop.io.compress.GzipCodec")
+	_, ok = registry.lookup("com.example.MyCodec")
+	assert.False(ok)
+
+	assert.NoError(registry.register(CodecInfo{ClassName: "com.example.MyCodec", Aliases: []string{"zlib"}, Extension: ".gz", Codec: &Lz4Codec{}}, true))
+	info, ok = registry.lookup("zlib")
+	assert.True(ok)
+	assert.Equal("com.example.MyCodec", info.ClassName)
+	info, ok = registry.lookupByFileName("data.gz")
+	assert.True(ok)
+	assert.Equal("com.example.MyCodec", info.ClassName)
+	info, ok = registry.lookup("org.apache.hadoop.io.compress.DefaultCodec")
+	assert.True(ok)
+	assert.Equal([]string{"deflate"}, info.Aliases)
+	info, ok = registry.lookup("gzip")
+	assert.True(ok)
+	assert.Equal("", info.Extension)
+
+	assert.Error(registry.register(CodecInfo{ClassName: "com.example.NilCodec"}, false))
+	assert.Error(registry.register(CodecInfo{Codec: &Lz4Codec{}}, false))
+	assert.Error(registry.register(CodecInfo{ClassName: "com.example.BadCodec", Extension: "bad", Codec: &Lz4Codec{}}, false))
+}
+
+func BenchmarkCodecCompress(b *testing.B) {
+	data := genCompressibleData(1 << 20)
+	for _, info := range RegisteredCodecs() {
+		codec := info.Codec
+		b.Run(info.ClassName[strings.LastIndex(info.ClassName, ".")+1:], func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				dst, err = codec.Compress(dst[:0], data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUncompress(b *testing.B) {
+	data := genCompressibleData(1 << 20)
+	for _, info := range RegisteredCodecs() {
+		codec := info.Codec
+		b.Run(info.ClassName[strings.LastIndex(info.ClassName, ".")+1:], func(b *testing.B) {
+			compressed, err := codec.Compress(nil, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				dst, err = codec.Uncompress(dst[:0], compressed)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random under the race detector")
+	}
+	// a collection would empty the pools as well
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	assert := assert.New(t)
+	data := genCompressibleData(100000)
+	for codec, maxAllocs := range map[Codec]float64{
+		&ZlibCodec{}:      10, // compress/flate allocates huffman tables per block
+		&GzipCodec{}:      10,
+		&Lz4Codec{}:       0,
+		&SnappyCodec{}:    0,
+		&ZStandardCodec{}: 0,
+		&LzoCodec{}:       0,
+		&Bzip2Codec{}:     25, // compress/bzip2 cannot be reset, so every Uncompress allocates a decoder
+	} {
+		compressed, err := codec.Compress(nil, data)
+		assert.NoError(err)
+		uncompressed, err := codec.Uncompress(nil, compressed)
+		assert.NoError(err)
+
+		// with enough room in dst, the result must be written in place
+		dst := make([]byte, 0, 2*len(compressed))
+		result, err := codec.Compress(dst, data)
+		assert.NoError(err)
+		assert.Equal(&dst[:1][0], &result[0], "%T", codec)
+		dst = make([]byte, 0, len(uncompressed))
+		result, err = codec.Uncompress(dst, compressed)
+		assert.NoError(err)
+		assert.Equal(&dst[:1][0], &result[0], "%T", codec)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			compressed, _ = codec.Compress(compressed[:0], data)
+			uncompressed, _ = codec.Uncompress(uncompressed[:0], compressed)
+		})
+		assert.True(allocs <= maxAllocs+0.5, "%T: %v allocs", codec, allocs)
+	}
+}
+
+// storeCompressor is a RawBlockCompressor that stores chunks as is.
+type storeCompressor struct{}
+
+func (storeCompressor) CompressBlock(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (storeCompressor) UncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	if len(src) > maxSize {
+		return nil, fmt.Errorf("chunk larger than block")
+	}
+	return append(dst, src...), nil
+}
+
+func (storeCompressor) CompressionOverhead(bufferSize int) int {
+	return 2
+}
+
+func TestBlockCodec(t *testing.T) {
+	assert := assert.New(t)
+	codec := &BlockCodec{Compressor: storeCompressor{}, BufferSize: 6}
+	compressed, err := codec.Compress(nil, []byte("abcdefghij"))
+	assert.NoError(err)
+	assert.Equal([]byte{
+		0x00, 0x00, 0x00, 0x0a, // uncompressed length
+		0x00, 0x00, 0x00, 0x04, 'a', 'b', 'c', 'd',
+		0x00, 0x00, 0x00, 0x04, 'e', 'f', 'g', 'h',
+		0x00, 0x00, 0x00, 0x02, 'i', 'j',
+	}, compressed)
+	testCodecRoundTrip(t, codec, genCompressibleData(1000))
+	testStreamRoundTrip(t, codec, genCompressibleData(1000))
+
+	_, err = codec.Uncompress(nil, compressed[:len(compressed)-1])
+	assert.Error(err)
+	compressed[3] = 0x09 // last chunk now expands past the block
+	_, err = codec.Uncompress(nil, compressed)
+	assert.Error(err)
+
+	_, err = (&BlockCodec{Compressor: storeCompressor{}, BufferSize: 2}).Compress(nil, []byte("a"))
+	assert.Error(err)
+	_, err = (&BlockCodec{Compressor: storeCompressor{}, BufferSize: 2}).NewReader(&bytes.Buffer{})
+	assert.Error(err)
+
+	// a chunk larger than the buffer size is rejected before it is read
+	for _, c := range []struct {
+		codec      CompressionCodec
+		bufferSize int
+	}{
+		{codec, 6},
+		{&Lz4Codec{}, LZ4_BUFFER_SIZE},
+		{&SnappyCodec{}, SNAPPY_BUFFER_SIZE},
+		{&LzoCodec{}, LZO_BUFFER_SIZE},
+	} {
+		reader, err := c.codec.NewReader(bytes.NewReader([]byte{
+			0x00, 0x00, 0x00, 0x0a, // uncompressed length
+			0x7f, 0xff, 0xff, 0xff, // compressed chunk length
+		}))
+		assert.NoError(err)
+		_, err = ioutil.ReadAll(reader)
+		assert.EqualError(err, fmt.Sprintf("chunk of %d bytes exceeds buffer size %d", 0x7fffffff, c.bufferSize))
+	}
+	configured, err := ConfigureCodec(codec, CodecOptions{BufferSize: 100})
+	assert.NoError(err)
+	assert.Equal(&BlockCodec{Compressor: storeCompressor{}, BufferSize: 100}, configured)
+}
+
+func TestBlockCodecBufferSize(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(100000)
+	for _, codec := range []Codec{&Lz4Codec{}, &SnappyCodec{}, &LzoCodec{}} {
+		configured, err := ConfigureCodec(codec, CodecOptions{BufferSize: 4096})
+		assert.NoError(err)
+		testCodecRoundTrip(t, configured, data)
+		testStreamRoundTrip(t, configured.(CompressionCodec), data)
+
+		// smaller chunks compress worse but are still readable by the default codec
+		small, err := configured.Compress(nil, data)
+		assert.NoError(err)
+		large, err := codec.Compress(nil, data)
+		assert.NoError(err)
+		assert.True(len(small) > len(large), "%T", codec)
+		uncompressed, err := codec.Uncompress(nil, small)
+		assert.NoError(err)
+		assert.True(bytes.Equal(data, uncompressed))
+
+		_, err = ConfigureCodec(codec, CodecOptions{BufferSize: 16})
+		assert.Error(err)
+		_, err = ConfigureCodec(codec, CodecOptions{Level: 1})
+		assert.Error(err)
+	}
+}
+
+func TestUncompressLimit(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 1<<20)
+	copy(data, genCompressibleData(1000))
+	codecs := []Codec{&bufferOnlyCodec{codec: &ZlibCodec{}}, FromStreamCodec(&streamOnlyCodec{codec: &ZlibCodec{}})}
+	for _, info := range RegisteredCodecs() {
+		codecs = append(codecs, info.Codec)
+	}
+	for _, codec := range codecs {
+		compressed, err := codec.Compress(nil, data)
+		assert.NoError(err)
+
+		uncompressed, err := UncompressLimit(codec, []byte("prefix"), compressed, len(data))
+		assert.NoError(err, "%T", codec)
+		assert.Equal(6+len(data), len(uncompressed))
+
+		for _, limit := range []int{len(data) - 1, 1000} {
+			_, err = UncompressLimit(codec, []byte("prefix"), compressed, limit)
+			var limitErr *DecompressionLimitError
+			if assert.True(errors.As(err, &limitErr), "%T: %v", codec, err) {
+				assert.Equal(limit, limitErr.Limit)
+			}
+		}
+	}
+}
+
+func TestNewReaderLimit(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 1<<20)
+	copy(data, genCompressibleData(1000))
+	codecs := []CompressionCodec{AsCompressionCodec(&bufferOnlyCodec{codec: &ZlibCodec{}}), FromStreamCodec(&streamOnlyCodec{codec: &ZlibCodec{}})}
+	for _, info := range RegisteredCodecs() {
+		codecs = append(codecs, AsCompressionCodec(info.Codec))
+	}
+	for _, codec := range codecs {
+		compressed, err := codec.Compress(nil, data)
+		assert.NoError(err)
+
+		reader, err := NewReaderLimit(codec, bytes.NewReader(compressed), len(data))
+		assert.NoError(err, "%T", codec)
+		uncompressed, err := ioutil.ReadAll(reader)
+		assert.NoError(err, "%T", codec)
+		assert.True(bytes.Equal(data, uncompressed), "%T", codec)
+
+		for _, limit := range []int{len(data) - 1, 1000} {
+			reader, err := NewReaderLimit(codec, bytes.NewReader(compressed), limit)
+			if err == nil {
+				uncompressed, err = ioutil.ReadAll(reader)
+				assert.True(len(uncompressed) <= limit, "%T", codec)
+			}
+			var limitErr *DecompressionLimitError
+			if assert.True(errors.As(err, &limitErr), "%T: %v", codec, err) {
+				assert.Equal(limit, limitErr.Limit)
+			}
+		}
+	}
+	_, err := NewReaderLimit(&ZlibCodec{}, &bytes.Buffer{}, -1)
+	assert.Error(err)
+}
+
+func TestBlockReaderMemory(t *testing.T) {
+	assert := assert.New(t)
+	// a single block of 64MB, which streams must not buffer as a whole
+	compressed, err := (&Lz4Codec{}).Compress(nil, make([]byte, 64<<20))
+	assert.NoError(err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reader, err := NewReaderLimit(&Lz4Codec{}, bytes.NewReader(compressed), 1<<20)
+	assert.NoError(err)
+	_, err = io.Copy(ioutil.Discard, reader)
+	runtime.ReadMemStats(&after)
+	assert.Equal(&DecompressionLimitError{Limit: 1 << 20}, err)
+	assert.True(after.TotalAlloc-before.TotalAlloc < 4<<20, "%d bytes allocated", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestUncompressLimitDeclaredSize(t *testing.T) {
+	assert := assert.New(t)
+	// a block claiming to expand to 2GB must be rejected before allocating
+	framed := []byte{
+		0x7f, 0xff, 0xff, 0xff, // uncompressed length
+		0x00, 0x00, 0x00, 0x02, // compressed chunk length
+		0x10, 'x',
+	}
+	_, err := (&Lz4Codec{}).UncompressLimit(nil, framed, 1<<20)
+	assert.Equal(&DecompressionLimitError{Limit: 1 << 20}, err)
+
+	// without a limit, the declared sizes must not be allocated up front
+	snappyFramed := []byte{
+		0x7f, 0xff, 0xff, 0xff, // uncompressed length
+		0x00, 0x00, 0x00, 0x07, // compressed chunk length
+		0xff, 0xff, 0xff, 0xff, 0x07, // snappy uncompressed length
+		0x00, 'x',
+	}
+	for codec, framed := range map[Codec][]byte{&Lz4Codec{}: framed, &SnappyCodec{}: snappyFramed} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err = codec.Uncompress(nil, framed)
+		runtime.ReadMemStats(&after)
+		assert.Error(err, "%T", codec)
+		assert.True(after.TotalAlloc-before.TotalAlloc < 1<<20, "%T: %d bytes allocated", codec, after.TotalAlloc-before.TotalAlloc)
+	}
+}
@@ -0,0 +1,203 @@
+package hadoop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PENDING_DIR_NAME     = "_temporary"
+	SUCCEEDED_FILE_NAME  = "_SUCCESS"
+	MAP_TASK             = 'm'
+	REDUCE_TASK          = 'r'
+	DEFAULT_APP_ATTEMPT  = 0
+	DEFAULT_JOB_TRACKER  = "local"
+	COMMITTER_ALGORITHM1 = 1
+	COMMITTER_ALGORITHM2 = 2
+)
+
+// TaskAttemptID mirrors org.apache.hadoop.mapreduce.TaskAttemptID, e.g.
+// attempt_local_0001_r_000003_0.
+type TaskAttemptID struct {
+	JobTrackerID string
+	Job          int
+	Type         byte // MAP_TASK or REDUCE_TASK
+	Task         int
+	Attempt      int
+}
+
+func (id TaskAttemptID) String() string {
+	return fmt.Sprintf("attempt_%s_%04d_%c_%06d_%d", id.jobTrackerID(), id.Job, id.Type, id.Task, id.Attempt)
+}
+
+// TaskID returns the ID of the task this is an attempt of, e.g.
+// task_local_0001_r_000003.
+func (id TaskAttemptID) TaskID() string {
+	return fmt.Sprintf("task_%s_%04d_%c_%06d", id.jobTrackerID(), id.Job, id.Type, id.Task)
+}
+
+// PartName returns the name FileOutputFormat gives to the output of the
+// task, e.g. part-r-00003.
+func (id TaskAttemptID) PartName() string {
+	return fmt.Sprintf("part-%c-%05d", id.Type, id.Task)
+}
+
+func (id TaskAttemptID) jobTrackerID() string {
+	if id.JobTrackerID == "" {
+		return DEFAULT_JOB_TRACKER
+	}
+	return id.JobTrackerID
+}
+
+// FileOutputCommitter lays out job output the way Hadoop's FileOutputCommitter
+// does, so that Hive, Spark and MapReduce can consume it. Tasks write under
+// <output>/_temporary/<app attempt>/_temporary/<task attempt>/. With algorithm
+// 1, CommitTask moves the task output to <output>/_temporary/<app attempt>/<task>/
+// and CommitJob merges all committed tasks into the output directory. With
+// algorithm 2, CommitTask merges the task output into the output directory
+// right away. CommitJob then removes _temporary and writes _SUCCESS.
+type FileOutputCommitter struct {
+	OutputDir  string
+	Algorithm  int
+	AppAttempt int
+
+	// SkipSuccessMarker disables writing _SUCCESS on CommitJob, like
+	// mapreduce.fileoutputcommitter.marksuccessfuljobs=false.
+	SkipSuccessMarker bool
+}
+
+func NewFileOutputCommitter(outputDir string, algorithm int) (*FileOutputCommitter, error) {
+	if algorithm != COMMITTER_ALGORITHM1 && algorithm != COMMITTER_ALGORITHM2 {
+		return nil, fmt.Errorf("unsupported committer algorithm version %d", algorithm)
+	}
+	return &FileOutputCommitter{
+		OutputDir:  outputDir,
+		Algorithm:  algorithm,
+		AppAttempt: DEFAULT_APP_ATTEMPT,
+	}, nil
+}
+
+func (self *FileOutputCommitter) pendingPath() string {
+	return filepath.Join(self.OutputDir, PENDING_DIR_NAME)
+}
+
+func (self *FileOutputCommitter) jobAttemptPath() string {
+	return filepath.Join(self.pendingPath(), fmt.Sprint(self.AppAttempt))
+}
+
+func (self *FileOutputCommitter) committedTaskPath(id TaskAttemptID) string {
+	return filepath.Join(self.jobAttemptPath(), id.TaskID())
+}
+
+// TaskWorkPath returns the directory a task attempt writes its output to.
+func (self *FileOutputCommitter) TaskWorkPath(id TaskAttemptID) string {
+	return filepath.Join(self.jobAttemptPath(), PENDING_DIR_NAME, id.String())
+}
+
+func (self *FileOutputCommitter) SetupJob() error {
+	return os.MkdirAll(self.jobAttemptPath(), 0755)
+}
+
+func (self *FileOutputCommitter) SetupTask(id TaskAttemptID) error {
+	return os.MkdirAll(self.TaskWorkPath(id), 0755)
+}
+
+// CreateSequenceFile creates the part file of a task attempt in its work path.
+func (self *FileOutputCommitter) CreateSequenceFile(id TaskAttemptID, opts *SequenceFileWriterOpts) (*SequenceFileWriter, error) {
+	if err := self.SetupTask(id); err != nil {
+		return nil, err
+	}
+	return CreateSequenceFile(filepath.Join(self.TaskWorkPath(id), id.PartName()), opts)
+}
+
+// CommitTask publishes the output of a task attempt. Writers created for the
+// attempt must be closed first.
+func (self *FileOutputCommitter) CommitTask(id TaskAttemptID) error {
+	workPath := self.TaskWorkPath(id)
+	if _, err := os.Stat(workPath); os.IsNotExist(err) {
+		return nil // no output
+	} else if err != nil {
+		return err
+	}
+
+	if self.Algorithm == COMMITTER_ALGORITHM1 {
+		committedPath := self.committedTaskPath(id)
+		if err := os.RemoveAll(committedPath); err != nil {
+			return err
+		}
+		return os.Rename(workPath, committedPath)
+	}
+	if err := mergePaths(workPath, self.OutputDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(workPath)
+}
+
+func (self *FileOutputCommitter) AbortTask(id TaskAttemptID) error {
+	return os.RemoveAll(self.TaskWorkPath(id))
+}
+
+func (self *FileOutputCommitter) CommitJob() error {
+	if self.Algorithm == COMMITTER_ALGORITHM1 {
+		entries, err := os.ReadDir(self.jobAttemptPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Name() == PENDING_DIR_NAME {
+				continue
+			}
+			if err := mergePaths(filepath.Join(self.jobAttemptPath(), entry.Name()), self.OutputDir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(self.pendingPath()); err != nil {
+		return err
+	}
+	if self.SkipSuccessMarker {
+		return nil
+	}
+	fp, err := os.Create(filepath.Join(self.OutputDir, SUCCEEDED_FILE_NAME))
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+func (self *FileOutputCommitter) AbortJob() error {
+	return os.RemoveAll(self.pendingPath())
+}
+
+// Ported from FileOutputCommitter.mergePaths
+func mergePaths(from string, to string) error {
+	fromInfo, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	toInfo, err := os.Stat(to)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !fromInfo.IsDir() || toInfo == nil || !toInfo.IsDir() {
+		if toInfo != nil {
+			if err := os.RemoveAll(to); err != nil {
+				return err
+			}
+		}
+		return os.Rename(from, to)
+	}
+
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := mergePaths(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package hadoop
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCommitter(t *testing.T, algorithm int) {
+	assert := assert.New(t)
+	dir := filepath.Join(t.TempDir(), "out")
+
+	committer, err := NewFileOutputCommitter(dir, algorithm)
+	assert.NoError(err)
+	assert.NoError(committer.SetupJob())
+
+	var key LongWritable
+	var value BytesWritable
+	for task := 0; task < 3; task++ {
+		for attempt := 0; attempt < 2; attempt++ {
+			id := TaskAttemptID{Job: 1, Type: REDUCE_TASK, Task: task, Attempt: attempt}
+			writer, err := committer.CreateSequenceFile(id, &SequenceFileWriterOpts{})
+			assert.NoError(err)
+			assert.NoError(writer.Write(&key, &value))
+			assert.NoError(writer.Close())
+			// The first attempt of each task fails.
+			if attempt == 0 {
+				assert.NoError(committer.AbortTask(id))
+			} else {
+				assert.NoError(committer.CommitTask(id))
+			}
+		}
+	}
+	assert.NoError(committer.CommitJob())
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(err)
+	assert.Equal([]string{
+		filepath.Join(dir, "_SUCCESS"),
+		filepath.Join(dir, "part-r-00000"),
+		filepath.Join(dir, "part-r-00001"),
+		filepath.Join(dir, "part-r-00002"),
+	}, matches)
+}
+
+func TestCommitterAlgorithm1(t *testing.T) {
+	testCommitter(t, COMMITTER_ALGORITHM1)
+}
+
+func TestCommitterAlgorithm2(t *testing.T) {
+	testCommitter(t, COMMITTER_ALGORITHM2)
+}
+
+func TestCommitterAbortJob(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	committer, err := NewFileOutputCommitter(dir, COMMITTER_ALGORITHM1)
+	assert.NoError(err)
+	assert.NoError(committer.SetupJob())
+	id := TaskAttemptID{Job: 1, Type: MAP_TASK}
+	assert.Equal("attempt_local_0001_m_000000_0", id.String())
+	writer, err := committer.CreateSequenceFile(id, &SequenceFileWriterOpts{})
+	assert.NoError(err)
+	assert.NoError(writer.Close())
+	assert.NoError(committer.CommitTask(id))
+	assert.NoError(committer.AbortJob())
+
+	_, err = os.Stat(filepath.Join(dir, PENDING_DIR_NAME))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "part-m-00000"))
+	assert.True(os.IsNotExist(err))
+}
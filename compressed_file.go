@@ -0,0 +1,122 @@
+package hadoop
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type CompressedFileReaderOpts struct {
+	// MaxSize limits the decompressed size of a compressed file. Reading
+	// past it fails with a *DecompressionLimitError. Files that are not
+	// compressed are not limited. Zero means no limit.
+	MaxSize int
+}
+
+// NewCompressedFileReader decompresses r with the codec registered for the
+// extension of name, like Hadoop's CompressionCodecFactory does for text job
+// outputs. If no codec matches, r is returned as is. Closing the returned
+// reader does not close r.
+func NewCompressedFileReader(r io.Reader, name string) (io.ReadCloser, error) {
+	return NewCompressedFileReaderWithOpts(r, name, &CompressedFileReaderOpts{})
+}
+
+func NewCompressedFileReaderWithOpts(r io.Reader, name string, opts *CompressedFileReaderOpts) (io.ReadCloser, error) {
+	if opts.MaxSize < 0 {
+		return nil, fmt.Errorf("max size must not be negative")
+	}
+	info, ok := LookupCodecByFileName(name)
+	if !ok {
+		return ioutil.NopCloser(r), nil
+	}
+	return NewReaderLimit(AsCompressionCodec(info.Codec), r, opts.MaxSize)
+}
+
+// NewCompressedFileWriter compresses to w with the codec registered for the
+// extension of name, configured with opts. If no codec matches, the data is
+// written as is. Closing the returned writer flushes the codec but does not
+// close w.
+func NewCompressedFileWriter(w io.Writer, name string, opts CodecOptions) (io.WriteCloser, error) {
+	info, ok := LookupCodecByFileName(name)
+	if !ok {
+		return nopWriteCloser{w}, nil
+	}
+	codec, err := ConfigureCodec(info.Codec, opts)
+	if err != nil {
+		return nil, err
+	}
+	return AsCompressionCodec(codec).NewWriter(w)
+}
+
+// OpenCompressedFile opens the named file for reading through
+// NewCompressedFileReader. Closing the returned reader closes the file.
+func OpenCompressedFile(path string) (io.ReadCloser, error) {
+	return OpenCompressedFileWithOpts(path, &CompressedFileReaderOpts{})
+}
+
+func OpenCompressedFileWithOpts(path string, opts *CompressedFileReaderOpts) (io.ReadCloser, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewCompressedFileReaderWithOpts(fp, path, opts)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &compressedFileReader{ReadCloser: reader, file: fp}, nil
+}
+
+// CreateCompressedFile creates or truncates the named file and returns a
+// writer compressing into it through NewCompressedFileWriter. Closing the
+// returned writer flushes the codec and closes the file.
+func CreateCompressedFile(path string, opts CodecOptions) (io.WriteCloser, error) {
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := NewCompressedFileWriter(fp, path, opts)
+	if err != nil {
+		fp.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &compressedFileWriter{WriteCloser: writer, file: fp}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressedFileReader and compressedFileWriter close the codec stream
+// before the file underneath it.
+type compressedFileReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (self *compressedFileReader) Close() error {
+	err := self.ReadCloser.Close()
+	if closeErr := self.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type compressedFileWriter struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (self *compressedFileWriter) Close() error {
+	err := self.WriteCloser.Close()
+	if closeErr := self.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
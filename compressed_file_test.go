@@ -0,0 +1,119 @@
+package hadoop
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedFile(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(1 << 20)
+	for _, ext := range []string{".deflate", ".gz", ".bz2", ".lz4", ".snappy", ".zst", ".lzo_deflate", ".lzo", ".txt"} {
+		path := filepath.Join(t.TempDir(), "part-r-00000"+ext)
+		writer, err := CreateCompressedFile(path, CodecOptions{})
+		assert.NoError(err)
+		for i := 0; i < len(data); i += 100000 {
+			end := i + 100000
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err := writer.Write(data[i:end])
+			assert.NoError(err)
+		}
+		assert.NoError(writer.Close())
+
+		reader, err := OpenCompressedFile(path)
+		assert.NoError(err)
+		uncompressed, err := ioutil.ReadAll(reader)
+		assert.NoError(err, ext)
+		assert.NoError(reader.Close())
+		assert.True(bytes.Equal(data, uncompressed), ext)
+
+		raw, err := ioutil.ReadFile(path)
+		assert.NoError(err)
+		if ext == ".txt" {
+			assert.True(bytes.Equal(data, raw))
+		} else {
+			assert.True(len(raw) < len(data)/2, ext)
+		}
+	}
+}
+
+func TestCompressedFileFormats(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(10000)
+
+	// .gz and .deflate are plain gzip and zlib streams
+	var buf bytes.Buffer
+	writer, err := NewCompressedFileWriter(&buf, "a.gz", CodecOptions{Level: 9})
+	assert.NoError(err)
+	writer.Write(data)
+	assert.NoError(writer.Close())
+	gzipReader, err := gzip.NewReader(&buf)
+	assert.NoError(err)
+	uncompressed, err := ioutil.ReadAll(gzipReader)
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, uncompressed))
+
+	buf.Reset()
+	zlibWriter := zlib.NewWriter(&buf)
+	zlibWriter.Write(data)
+	zlibWriter.Close()
+	reader, err := NewCompressedFileReader(&buf, "/out/part-00000.deflate")
+	assert.NoError(err)
+	uncompressed, err = ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, uncompressed))
+
+	// .snappy uses Hadoop block framing rather than the snappy framing format
+	buf.Reset()
+	writer, err = NewCompressedFileWriter(&buf, "a.snappy", CodecOptions{})
+	assert.NoError(err)
+	writer.Write(data)
+	assert.NoError(writer.Close())
+	assert.Equal([]byte{0x00, 0x00, 0x27, 0x10}, buf.Bytes()[:4])
+
+	_, err = NewCompressedFileWriter(&buf, "a.zst", CodecOptions{Level: 23})
+	assert.Error(err)
+}
+
+func TestCompressedFileMaxSize(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(100000)
+	for _, ext := range []string{".deflate", ".gz", ".bz2", ".lz4", ".snappy", ".zst", ".lzo_deflate", ".lzo"} {
+		path := filepath.Join(t.TempDir(), "part-r-00000"+ext)
+		writer, err := CreateCompressedFile(path, CodecOptions{})
+		assert.NoError(err)
+		_, err = writer.Write(data)
+		assert.NoError(err)
+		assert.NoError(writer.Close())
+
+		reader, err := OpenCompressedFileWithOpts(path, &CompressedFileReaderOpts{MaxSize: len(data)})
+		assert.NoError(err)
+		uncompressed, err := ioutil.ReadAll(reader)
+		assert.NoError(err, ext)
+		assert.NoError(reader.Close())
+		assert.True(bytes.Equal(data, uncompressed), ext)
+
+		reader, err = OpenCompressedFileWithOpts(path, &CompressedFileReaderOpts{MaxSize: len(data) - 1})
+		assert.NoError(err)
+		_, err = ioutil.ReadAll(reader)
+		assert.Equal(&DecompressionLimitError{Limit: len(data) - 1}, err, ext)
+		assert.NoError(reader.Close())
+	}
+
+	// files that are not compressed are not limited
+	reader, err := NewCompressedFileReaderWithOpts(bytes.NewReader(data), "part-r-00000", &CompressedFileReaderOpts{MaxSize: 1})
+	assert.NoError(err)
+	uncompressed, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, uncompressed))
+	_, err = NewCompressedFileReaderWithOpts(bytes.NewReader(data), "a.gz", &CompressedFileReaderOpts{MaxSize: -1})
+	assert.Error(err)
+}
@@ -2,8 +2,32 @@ package hadoop
 
 import "io"
 import "encoding/binary"
+import "sync/atomic"
+import "fmt"
+import "math"
+import "unicode/utf16"
+
+// countingWriter counts the bytes written through it. Offset may be called
+// concurrently with Write.
+type countingWriter struct {
+	writer io.Writer
+	offset int64
+}
+
+func (self *countingWriter) Write(p []byte) (int, error) {
+	n, err := self.writer.Write(p)
+	atomic.AddInt64(&self.offset, int64(n))
+	return n, err
+}
+
+func (self *countingWriter) Offset() int64 {
+	return atomic.LoadInt64(&self.offset)
+}
 
 func ReadByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok { // avoids allocating buf for bytes.Reader
+		return br.ReadByte()
+	}
 	var buf [1]byte
 	if _, err := io.ReadFull(r, buf[:]); err != nil {
 		return 0, err
@@ -11,6 +35,9 @@ func ReadByte(r io.Reader) (byte, error) {
 	return buf[0], nil
 }
 func WriteByte(w io.Writer, b byte) error {
+	if bw, ok := w.(io.ByteWriter); ok {
+		return bw.WriteByte(b)
+	}
 	var buf [1]byte
 	buf[0] = b
 	if _, err := w.Write(buf[:]); err != nil {
@@ -40,7 +67,7 @@ func ReadVLong(r io.Reader) (int64, error) {
 	}
 	len := DecodeVIntSize(fst)
 	if len == 1 {
-		return int64(fst), nil
+		return int64(int8(fst)), nil
 	}
 	var result int64 = 0
 	for idx := 0; idx < len-1; idx++ {
@@ -104,6 +131,108 @@ func WriteVLong(w io.Writer, i int64) (int, error) {
 	return nn, nil
 }
 
+// ReadVInt is ReadVLong for values that must fit in an int32, like
+// WritableUtils.readVInt.
+func ReadVInt(r io.Reader) (int32, error) {
+	v, err := ReadVLong(r)
+	if err != nil {
+		return 0, err
+	}
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return 0, fmt.Errorf("value %d too long to fit in integer", v)
+	}
+	return int32(v), nil
+}
+func WriteVInt(w io.Writer, i int32) (int, error) {
+	return WriteVLong(w, int64(i))
+}
+
+// ReadUTF reads a string written by DataOutput.writeUTF: an unsigned 16-bit
+// length followed by the string in modified UTF-8.
+func ReadUTF(r io.Reader) (string, error) {
+	return readJavaUTF(r, true)
+}
+
+// WriteUTF is the inverse of ReadUTF. NUL is written as two bytes and
+// characters outside the BMP as two surrogates of three bytes each, like
+// DataOutput.writeUTF.
+func WriteUTF(w io.Writer, s string) (int, error) {
+	return writeJavaUTF(w, s, true)
+}
+
+// readUTF8 and writeUTF8 are UTF8.readString and UTF8.writeString of
+// Hadoop's deprecated UTF8 class, as used by ObjectWritable. They differ from
+// ReadUTF and WriteUTF in writing NUL as a single byte and in also reading
+// 4-byte sequences. Where UTF8.writeString would truncate a string longer
+// than 21845 characters, writeUTF8 fails.
+func readUTF8(r io.Reader) (string, error) {
+	return readJavaUTF(r, false)
+}
+
+func writeUTF8(w io.Writer, s string) (int, error) {
+	return writeJavaUTF(w, s, false)
+}
+
+func readJavaUTF(r io.Reader, modified bool) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	chars := make([]uint16, 0, len(buf))
+	for i := 0; i < len(buf); {
+		b := buf[i]
+		switch {
+		case b < 0x80:
+			chars = append(chars, uint16(b))
+			i++
+		case b&0xe0 == 0xc0 && i+1 < len(buf) && buf[i+1]&0xc0 == 0x80:
+			chars = append(chars, uint16(b&0x1f)<<6|uint16(buf[i+1]&0x3f))
+			i += 2
+		case b&0xf0 == 0xe0 && i+2 < len(buf) && buf[i+1]&0xc0 == 0x80 && buf[i+2]&0xc0 == 0x80:
+			chars = append(chars, uint16(b&0x0f)<<12|uint16(buf[i+1]&0x3f)<<6|uint16(buf[i+2]&0x3f))
+			i += 3
+		case !modified && b&0xf8 == 0xf0 && i+3 < len(buf) && buf[i+1]&0xc0 == 0x80 && buf[i+2]&0xc0 == 0x80 && buf[i+3]&0xc0 == 0x80:
+			c := rune(b&0x07)<<18 | rune(buf[i+1]&0x3f)<<12 | rune(buf[i+2]&0x3f)<<6 | rune(buf[i+3]&0x3f)
+			high, low := utf16.EncodeRune(c)
+			chars = append(chars, uint16(high), uint16(low))
+			i += 4
+		default:
+			return "", fmt.Errorf("malformed UTF-8 around byte %d", i)
+		}
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+func writeJavaUTF(w io.Writer, s string, modified bool) (int, error) {
+	chars := utf16.Encode([]rune(s))
+	if !modified && len(chars) > math.MaxUint16/3 {
+		return 0, fmt.Errorf("string too long: %d characters", len(chars))
+	}
+	buf := make([]byte, 2, 2+len(s))
+	for _, c := range chars {
+		switch {
+		case c < 0x80 && (c != 0 || !modified):
+			buf = append(buf, byte(c))
+		case c < 0x800:
+			buf = append(buf, byte(0xc0|c>>6), byte(0x80|c&0x3f))
+		default:
+			buf = append(buf, byte(0xe0|c>>12), byte(0x80|c>>6&0x3f), byte(0x80|c&0x3f))
+		}
+	}
+	if len(buf)-2 > math.MaxUint16 {
+		return 0, fmt.Errorf("encoded string too long: %d bytes", len(buf)-2)
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+	return w.Write(buf)
+}
+
 func ReadBoolean(r io.Reader) (bool, error) {
 	b, err := ReadByte(r)
 	if err != nil {
@@ -140,12 +269,45 @@ func ReadBuffer(r io.Reader) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if size < 0 {
+		return nil, fmt.Errorf("negative buffer size %d", size)
+	}
 	buf := make([]byte, size)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
 	return buf, nil
 }
+
+// readBufferInto is like ReadBuffer but reads into dst if it is large enough.
+// Beyond the capacity of dst, it only allocates as the data actually arrives,
+// so a corrupt size cannot make it allocate a huge buffer up front.
+func readBufferInto(r io.Reader, dst []byte) ([]byte, error) {
+	size, err := ReadVLong(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("negative buffer size %d", size)
+	}
+	dst = dst[:0]
+	for int64(len(dst)) < size {
+		n := size - int64(len(dst))
+		if n > 1<<20 && int64(cap(dst)-len(dst)) < n {
+			n = 1 << 20
+		}
+		dst = growSlice(dst, int(n))
+		if _, err := io.ReadFull(r, dst[len(dst):len(dst)+int(n)]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		dst = dst[:len(dst)+int(n)]
+	}
+	return dst, nil
+}
+
 func WriteBuffer(w io.Writer, buf []byte) (int, error) {
 	nn, err := WriteVLong(w, int64(len(buf)))
 	if err != nil {
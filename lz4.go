@@ -0,0 +1,182 @@
+package hadoop
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Pure Go implementation of the LZ4 block format, as produced by
+// LZ4_compress_default and consumed by LZ4_decompress_safe.
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // the last 5 bytes are always literals
+	lz4MFLimit      = 12 // the last match must start at least 12 bytes before the end
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+var errLz4Corrupt = errors.New("lz4: corrupt input")
+
+type lz4Compressor struct{}
+
+func (lz4Compressor) CompressBlock(dst, src []byte) ([]byte, error) {
+	return lz4CompressBlock(dst, src)
+}
+
+func (lz4Compressor) UncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	return lz4UncompressBlock(dst, src, maxSize)
+}
+
+func (lz4Compressor) CompressionOverhead(bufferSize int) int {
+	return bufferSize/255 + 16
+}
+
+// lz4Tables holds hash tables for lz4CompressBlock, which are too large to
+// live on the stack.
+var lz4Tables = sync.Pool{
+	New: func() interface{} { return new([1 << lz4HashLog]int32) },
+}
+
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func lz4AppendSequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	if matchLen > 0 {
+		if matchLen-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(matchLen - lz4MinMatch)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if matchLen-lz4MinMatch >= 15 {
+			dst = lz4AppendLength(dst, matchLen-lz4MinMatch-15)
+		}
+	}
+	return dst
+}
+
+// lz4CompressBlock appends the LZ4 block compressed form of src to dst.
+func lz4CompressBlock(dst, src []byte) ([]byte, error) {
+	anchor := 0
+	if len(src) > lz4MFLimit {
+		table := lz4Tables.Get().(*[1 << lz4HashLog]int32) // position + 1, zero means empty
+		*table = [1 << lz4HashLog]int32{}
+		defer lz4Tables.Put(table)
+		matchLimit := len(src) - lz4LastLiterals
+		for si := 0; si < len(src)-lz4MFLimit; {
+			seq := binary.LittleEndian.Uint32(src[si:])
+			h := lz4Hash(seq)
+			ref := int(table[h]) - 1
+			table[h] = int32(si + 1)
+			if ref < 0 || si-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				si++
+				continue
+			}
+
+			// Extend the match backwards over pending literals, then forwards.
+			for si > anchor && ref > 0 && src[si-1] == src[ref-1] {
+				si--
+				ref--
+			}
+			matchLen := lz4MinMatch
+			for si+matchLen < matchLimit && src[si+matchLen] == src[ref+matchLen] {
+				matchLen++
+			}
+
+			dst = lz4AppendSequence(dst, src[anchor:si], si-ref, matchLen)
+			si += matchLen
+			anchor = si
+		}
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0), nil
+}
+
+// lz4UncompressBlock appends the decompressed form of the LZ4 block src to dst.
+// It fails if the block expands to more than maxSize bytes.
+func lz4UncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	start := len(dst)
+	si := 0
+	for si < len(src) {
+		token := src[si]
+		si++
+
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			for {
+				if si >= len(src) {
+					return nil, errLz4Corrupt
+				}
+				b := src[si]
+				si++
+				litLen += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		if litLen > len(src)-si || litLen > maxSize-(len(dst)-start) {
+			return nil, errLz4Corrupt
+		}
+		dst = append(dst, src[si:si+litLen]...)
+		si += litLen
+		if si == len(src) {
+			// the last sequence has no match
+			return dst, nil
+		}
+
+		if si+2 > len(src) {
+			return nil, errLz4Corrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[si:]))
+		si += 2
+		if offset == 0 || offset > len(dst)-start {
+			return nil, errLz4Corrupt
+		}
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			for {
+				if si >= len(src) {
+					return nil, errLz4Corrupt
+				}
+				b := src[si]
+				si++
+				matchLen += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+		matchLen += lz4MinMatch
+		if matchLen > maxSize-(len(dst)-start) {
+			return nil, errLz4Corrupt
+		}
+		pos := len(dst) - offset
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[pos+i])
+		}
+	}
+	return nil, errLz4Corrupt
+}
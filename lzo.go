@@ -0,0 +1,733 @@
+package hadoop
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// Pure Go implementation of LZO1X, as used by hadoop-lzo's LzoCodec and
+// LzopCodec. The decompressor follows lzo1x_d.ch. The compressor is a greedy
+// single-pass matcher emitting LZO1X-1 compatible streams.
+
+const (
+	lzoM2MaxLen    = 8
+	lzoM2MaxOffset = 0x0800
+	lzoM3MaxOffset = 0x4000
+	lzoM4MaxOffset = 0xbfff
+	lzoMinMatch    = 4
+	lzoHashLog     = 14
+)
+
+var errLzoCorrupt = errors.New("lzo: corrupt input")
+
+// lzoAppendCount writes the part of a length exceeding the 2 to 5 bits that
+// fit in the instruction: runs of zero bytes worth 255 each, then the rest.
+func lzoAppendCount(dst []byte, n int) []byte {
+	for ; n > 255; n -= 255 {
+		dst = append(dst, 0)
+	}
+	return append(dst, byte(n))
+}
+
+type lzoEncoder struct {
+	dst []byte
+	// index of the byte holding the number of literals following the last
+	// match, or -1 at the start of the stream
+	state int
+}
+
+func (e *lzoEncoder) literals(lit []byte) {
+	n := len(lit)
+	switch {
+	case n == 0:
+		return
+	case e.state < 0 && n <= 238:
+		e.dst = append(e.dst, byte(17+n))
+	case e.state >= 0 && n <= 3:
+		e.dst[e.state] |= byte(n)
+	case n-3 <= 15:
+		e.dst = append(e.dst, byte(n-3))
+	default:
+		e.dst = append(e.dst, 0)
+		e.dst = lzoAppendCount(e.dst, n-3-15)
+	}
+	e.dst = append(e.dst, lit...)
+}
+
+func (e *lzoEncoder) match(offset int, length int) {
+	switch {
+	case length <= lzoM2MaxLen && offset <= lzoM2MaxOffset:
+		offset--
+		e.dst = append(e.dst, byte((length-1)<<5|(offset&7)<<2), byte(offset>>3))
+		e.state = len(e.dst) - 2
+		return
+	case offset <= lzoM3MaxOffset:
+		offset--
+		if length-2 <= 31 {
+			e.dst = append(e.dst, byte(32|(length-2)))
+		} else {
+			e.dst = append(e.dst, 32)
+			e.dst = lzoAppendCount(e.dst, length-2-31)
+		}
+	default:
+		offset -= 0x4000
+		token := byte(16 | (offset&0x4000)>>11)
+		if length-2 <= 7 {
+			e.dst = append(e.dst, token|byte(length-2))
+		} else {
+			e.dst = append(e.dst, token)
+			e.dst = lzoAppendCount(e.dst, length-2-7)
+		}
+	}
+	e.dst = append(e.dst, byte(offset<<2), byte(offset>>6))
+	e.state = len(e.dst) - 2
+}
+
+// lzoCompressBlock appends the LZO1X compressed form of src to dst.
+func lzoCompressBlock(dst, src []byte) ([]byte, error) {
+	e := lzoEncoder{dst: dst, state: -1}
+	var table [1 << lzoHashLog]int32 // position + 1, zero means empty
+	anchor := 0
+	for si := 0; si+lzoMinMatch <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[si:])
+		h := (seq * 0x1824429d) >> (32 - lzoHashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(si + 1)
+		if ref < 0 || si-ref > lzoM4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			si++
+			continue
+		}
+		length := lzoMinMatch
+		for si+length < len(src) && src[si+length] == src[ref+length] {
+			length++
+		}
+		e.literals(src[anchor:si])
+		e.match(si-ref, length)
+		si += length
+		anchor = si
+	}
+	e.literals(src[anchor:])
+	return append(e.dst, 16|1, 0, 0), nil // end of stream: M4 match with zero offset
+}
+
+// lzoUncompressBlock appends the decompressed form of the LZO1X block src to
+// dst. It fails if the block expands to more than maxSize bytes.
+func lzoUncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	start := len(dst)
+	ip := 0
+
+	next := func() (int, error) {
+		if ip >= len(src) {
+			return 0, errLzoCorrupt
+		}
+		ip++
+		return int(src[ip-1]), nil
+	}
+	count := func(t int, base int) (int, error) {
+		if t != 0 {
+			return t, nil
+		}
+		for {
+			b, err := next()
+			if err != nil {
+				return 0, err
+			}
+			if b != 0 {
+				return t + base + b, nil
+			}
+			t += 255
+		}
+	}
+	copyLiterals := func(n int) error {
+		if n > len(src)-ip || n > maxSize-(len(dst)-start) {
+			return errLzoCorrupt
+		}
+		dst = append(dst, src[ip:ip+n]...)
+		ip += n
+		return nil
+	}
+	copyMatch := func(distance int, n int) error {
+		if distance <= 0 || distance > len(dst)-start || n > maxSize-(len(dst)-start) {
+			return errLzoCorrupt
+		}
+		pos := len(dst) - distance
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[pos+i])
+		}
+		return nil
+	}
+
+	const (
+		literalRun = iota
+		firstLiteralRun
+		match
+		matchNext
+	)
+	state := literalRun
+	t := 0
+	if len(src) > 0 && src[0] > 17 {
+		ip++
+		t = int(src[0]) - 17
+		if t < 4 {
+			state = matchNext
+		} else {
+			if err := copyLiterals(t); err != nil {
+				return nil, err
+			}
+			state = firstLiteralRun
+		}
+	}
+
+	for {
+		var err error
+		switch state {
+		case literalRun:
+			if t, err = next(); err != nil {
+				return nil, err
+			}
+			if t >= 16 {
+				state = match
+				continue
+			}
+			if t, err = count(t, 15); err != nil {
+				return nil, err
+			}
+			if err = copyLiterals(t + 3); err != nil {
+				return nil, err
+			}
+			state = firstLiteralRun
+
+		case firstLiteralRun:
+			if t, err = next(); err != nil {
+				return nil, err
+			}
+			if t >= 16 {
+				state = match
+				continue
+			}
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if err = copyMatch(1+lzoM2MaxOffset+t>>2+b<<2, 3); err != nil {
+				return nil, err
+			}
+			state = matchNext
+			t = int(src[ip-2]) & 3
+
+		case match:
+			switch {
+			case t >= 64:
+				var b int
+				if b, err = next(); err != nil {
+					return nil, err
+				}
+				err = copyMatch(1+(t>>2)&7+b<<3, t>>5+1)
+			case t >= 32:
+				if t, err = count(t&31, 31); err != nil {
+					return nil, err
+				}
+				if ip+2 > len(src) {
+					return nil, errLzoCorrupt
+				}
+				distance := 1 + int(binary.LittleEndian.Uint16(src[ip:]))>>2
+				ip += 2
+				err = copyMatch(distance, t+2)
+			case t >= 16:
+				high := (t & 8) << 11
+				if t, err = count(t&7, 7); err != nil {
+					return nil, err
+				}
+				if ip+2 > len(src) {
+					return nil, errLzoCorrupt
+				}
+				distance := high + int(binary.LittleEndian.Uint16(src[ip:]))>>2
+				ip += 2
+				if distance == 0 {
+					if ip != len(src) {
+						return nil, fmt.Errorf("lzo: %d bytes of trailing input", len(src)-ip)
+					}
+					return dst, nil
+				}
+				err = copyMatch(distance+0x4000, t+2)
+			default:
+				var b int
+				if b, err = next(); err != nil {
+					return nil, err
+				}
+				err = copyMatch(1+t>>2+b<<2, 2)
+			}
+			if err != nil {
+				return nil, err
+			}
+			t = int(src[ip-2]) & 3
+			state = matchNext
+
+		case matchNext:
+			if t == 0 {
+				state = literalRun
+				continue
+			}
+			if err = copyLiterals(t); err != nil {
+				return nil, err
+			}
+			if t, err = next(); err != nil {
+				return nil, err
+			}
+			state = match
+		}
+	}
+}
+
+const (
+	LZO_BUFFER_SIZE = 256 * 1024 // io.compression.codec.lzo.buffersize
+
+	LZOP_VERSION        = 0x1010
+	LZOP_COMPAT_VERSION = 0x0940
+	LZO_LIBRARY_VERSION = 0x2060
+
+	lzopMethodLzo1x1   = 1
+	lzopMethodLzo1x15  = 2
+	lzopMethodLzo1x999 = 3
+
+	lzopFlagAdler32D   = 0x00000001
+	lzopFlagAdler32C   = 0x00000002
+	lzopFlagExtraField = 0x00000040
+	lzopFlagCrc32D     = 0x00000100
+	lzopFlagCrc32C     = 0x00000200
+	lzopFlagFilter     = 0x00000800
+	lzopFlagHeaderCrc  = 0x00001000
+)
+
+var LZOP_MAGIC = []byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a}
+
+// LzoCodec is BlockCodec with LZO1X blocks, like hadoop-lzo's LzoCodec.
+// CodecOptions.BufferSize is supported and defaults to LZO_BUFFER_SIZE.
+type LzoCodec struct {
+	bufferSize int
+}
+
+func (c *LzoCodec) WithOptions(opts CodecOptions) (Codec, error) {
+	bufferSize, err := blockBufferSize(lzoCompressor{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &LzoCodec{bufferSize: bufferSize}, nil
+}
+
+func (c *LzoCodec) compressionBufferSize() int {
+	if c.bufferSize == 0 {
+		return LZO_BUFFER_SIZE
+	}
+	return c.bufferSize
+}
+
+func (c *LzoCodec) Compress(dst, src []byte) ([]byte, error) {
+	return blockCompress(dst, src, lzoCompressor{}, c.compressionBufferSize())
+}
+
+func (c *LzoCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return blockUncompress(dst, src, lzoCompressor{}, 0)
+}
+
+func (c *LzoCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return blockUncompress(dst, src, lzoCompressor{}, limit)
+}
+
+type lzoCompressor struct{}
+
+func (lzoCompressor) CompressBlock(dst, src []byte) ([]byte, error) {
+	return lzoCompressBlock(dst, src)
+}
+
+func (lzoCompressor) UncompressBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	return lzoUncompressBlock(dst, src, maxSize)
+}
+
+func (lzoCompressor) CompressionOverhead(bufferSize int) int {
+	return bufferSize/16 + 64 + 3
+}
+
+// LzopCodec reads and writes the lzop container format, with its per-block
+// checksums, as produced by the lzop tool and hadoop-lzo's LzopCodec.
+type LzopCodec struct {
+}
+
+func (c *LzopCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := &appendWriter{buf: dst}
+	writer, err := newLzopWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.buf, nil
+}
+
+func (c *LzopCodec) Uncompress(dst, src []byte) ([]byte, error) {
+	return c.UncompressLimit(dst, src, 0)
+}
+
+func (c *LzopCodec) UncompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return readAllInto(dst, &lzopReader{reader: &byteReader{buf: src}, limit: limit}, limit)
+}
+
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+type byteReader struct {
+	buf []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// lzopReader decompresses an lzop stream, verifying the checksums it carries.
+type lzopReader struct {
+	reader       io.Reader
+	limit        int // if not zero, fail early on blocks declaring a larger size
+	flags        uint32
+	readHeader   bool
+	eof          bool
+	block        []byte
+	compressed   []byte
+	uncompressed []byte
+}
+
+func (r *lzopReader) Read(p []byte) (int, error) {
+	if !r.readHeader {
+		if err := r.parseHeader(); err != nil {
+			return 0, err
+		}
+		r.readHeader = true
+	}
+	for len(r.block) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.block)
+	r.block = r.block[n:]
+	return n, nil
+}
+
+func (r *lzopReader) parseHeader() error {
+	var magic [9]byte
+	if _, err := io.ReadFull(r.reader, magic[:]); err != nil {
+		return err
+	}
+	if string(magic[:]) != string(LZOP_MAGIC) {
+		return fmt.Errorf("lzop: bad magic")
+	}
+
+	// The header checksum covers everything from the version to the file name.
+	var header []byte
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r.reader, buf); err != nil {
+			return nil, err
+		}
+		header = append(header, buf...)
+		return buf, nil
+	}
+
+	buf, err := read(4)
+	if err != nil {
+		return err
+	}
+	version := binary.BigEndian.Uint16(buf)
+	if version < LZOP_COMPAT_VERSION {
+		return fmt.Errorf("lzop: unsupported version %#x", version)
+	}
+	if _, err := read(2); err != nil { // version needed to extract
+		return err
+	}
+	if buf, err = read(2); err != nil { // method, level
+		return err
+	}
+	if method := buf[0]; method != lzopMethodLzo1x1 && method != lzopMethodLzo1x15 && method != lzopMethodLzo1x999 {
+		return fmt.Errorf("lzop: unsupported method %d", method)
+	}
+	if buf, err = read(4); err != nil {
+		return err
+	}
+	r.flags = binary.BigEndian.Uint32(buf)
+	if r.flags&lzopFlagFilter != 0 {
+		return fmt.Errorf("lzop: filters are not supported")
+	}
+	if _, err = read(4 + 4 + 4); err != nil { // mode, mtime, mtime high
+		return err
+	}
+	if buf, err = read(1); err != nil {
+		return err
+	}
+	if _, err = read(int(buf[0])); err != nil { // file name
+		return err
+	}
+
+	var checksum [4]byte
+	if _, err := io.ReadFull(r.reader, checksum[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != r.newHeaderHash(header) {
+		return fmt.Errorf("lzop: header checksum mismatch")
+	}
+
+	if r.flags&lzopFlagExtraField != 0 {
+		header = nil
+		if buf, err = read(4); err != nil {
+			return err
+		}
+		if _, err = read(int(binary.BigEndian.Uint32(buf))); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r.reader, checksum[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(checksum[:]) != r.newHeaderHash(header) {
+			return fmt.Errorf("lzop: extra field checksum mismatch")
+		}
+	}
+	return nil
+}
+
+func (r *lzopReader) newHeaderHash(buf []byte) uint32 {
+	if r.flags&lzopFlagHeaderCrc != 0 {
+		return crc32.ChecksumIEEE(buf)
+	}
+	return adler32.Checksum(buf)
+}
+
+func (r *lzopReader) readBlock() error {
+	readInt := func() (uint32, error) {
+		var buf [4]byte
+		if _, err := io.ReadFull(r.reader, buf[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(buf[:]), nil
+	}
+
+	uncompressedSize, err := readInt()
+	if err != nil {
+		return err
+	}
+	if uncompressedSize == 0 {
+		r.eof = true
+		return nil
+	}
+	compressedSize, err := readInt()
+	if err != nil {
+		return err
+	}
+	if uncompressedSize > 64*1024*1024 || compressedSize > uncompressedSize {
+		return fmt.Errorf("lzop: bad block size")
+	}
+	if r.limit > 0 && int(uncompressedSize) > r.limit {
+		return &DecompressionLimitError{Limit: r.limit}
+	}
+
+	type check struct {
+		want uint32
+		hash hash.Hash32
+	}
+	var uncompressedChecks, compressedChecks []check
+	if r.flags&lzopFlagAdler32D != 0 {
+		want, err := readInt()
+		if err != nil {
+			return err
+		}
+		uncompressedChecks = append(uncompressedChecks, check{want, adler32.New()})
+	}
+	if r.flags&lzopFlagCrc32D != 0 {
+		want, err := readInt()
+		if err != nil {
+			return err
+		}
+		uncompressedChecks = append(uncompressedChecks, check{want, crc32.NewIEEE()})
+	}
+	if compressedSize < uncompressedSize {
+		if r.flags&lzopFlagAdler32C != 0 {
+			want, err := readInt()
+			if err != nil {
+				return err
+			}
+			compressedChecks = append(compressedChecks, check{want, adler32.New()})
+		}
+		if r.flags&lzopFlagCrc32C != 0 {
+			want, err := readInt()
+			if err != nil {
+				return err
+			}
+			compressedChecks = append(compressedChecks, check{want, crc32.NewIEEE()})
+		}
+	}
+
+	if cap(r.compressed) < int(compressedSize) {
+		r.compressed = make([]byte, compressedSize)
+	}
+	r.compressed = r.compressed[:compressedSize]
+	if _, err := io.ReadFull(r.reader, r.compressed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	for _, c := range compressedChecks {
+		c.hash.Write(r.compressed)
+		if c.hash.Sum32() != c.want {
+			return fmt.Errorf("lzop: compressed data checksum mismatch")
+		}
+	}
+
+	if compressedSize == uncompressedSize {
+		r.block = r.compressed // stored
+	} else {
+		r.uncompressed, err = lzoUncompressBlock(r.uncompressed[:0], r.compressed, int(uncompressedSize))
+		if err != nil {
+			return err
+		}
+		if len(r.uncompressed) != int(uncompressedSize) {
+			return fmt.Errorf("lzop: block size mismatch")
+		}
+		r.block = r.uncompressed
+	}
+	for _, c := range uncompressedChecks {
+		c.hash.Write(r.block)
+		if c.hash.Sum32() != c.want {
+			return fmt.Errorf("lzop: uncompressed data checksum mismatch")
+		}
+	}
+	return nil
+}
+
+// lzopWriter writes an lzop stream with Adler-32 checksums of both the
+// uncompressed and the compressed data of every block, like lzop does.
+type lzopWriter struct {
+	writer     io.Writer
+	buf        []byte
+	compressed []byte
+	err        error
+	closed     bool
+}
+
+func newLzopWriter(w io.Writer) (*lzopWriter, error) {
+	header := make([]byte, 0, 32)
+	header = binary.BigEndian.AppendUint16(header, LZOP_VERSION)
+	header = binary.BigEndian.AppendUint16(header, LZO_LIBRARY_VERSION)
+	header = binary.BigEndian.AppendUint16(header, LZOP_COMPAT_VERSION)
+	header = append(header, lzopMethodLzo1x1, 5)
+	header = binary.BigEndian.AppendUint32(header, lzopFlagAdler32D|lzopFlagAdler32C)
+	header = binary.BigEndian.AppendUint32(header, 0x81a4) // mode
+	header = binary.BigEndian.AppendUint32(header, 0)      // mtime
+	header = binary.BigEndian.AppendUint32(header, 0)      // mtime high
+	header = append(header, 0)                             // no file name
+	header = binary.BigEndian.AppendUint32(header, adler32.Checksum(header))
+
+	if _, err := w.Write(LZOP_MAGIC); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &lzopWriter{writer: w}, nil
+}
+
+func (w *lzopWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fmt.Errorf("lzop: write to closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := LZO_BUFFER_SIZE - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == LZO_BUFFER_SIZE {
+			if err := w.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *lzopWriter) writeBlock() error {
+	compressed, err := lzoCompressBlock(w.compressed[:0], w.buf)
+	if err != nil {
+		return err
+	}
+	w.compressed = compressed
+
+	header := make([]byte, 0, 16)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(w.buf)))
+	if len(compressed) < len(w.buf) {
+		header = binary.BigEndian.AppendUint32(header, uint32(len(compressed)))
+		header = binary.BigEndian.AppendUint32(header, adler32.Checksum(w.buf))
+		header = binary.BigEndian.AppendUint32(header, adler32.Checksum(compressed))
+	} else {
+		compressed = w.buf // store incompressible blocks as is
+		header = binary.BigEndian.AppendUint32(header, uint32(len(w.buf)))
+		header = binary.BigEndian.AppendUint32(header, adler32.Checksum(w.buf))
+	}
+	if _, err := w.writer.Write(header); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.writer.Write(compressed); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *lzopWriter) Close() error {
+	if w.err != nil || w.closed {
+		return w.err
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		if err := w.writeBlock(); err != nil {
+			return err
+		}
+	}
+	var end [4]byte
+	if _, err := w.writer.Write(end[:]); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
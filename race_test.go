@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package hadoop
+
+// raceEnabled tells that the race detector is on, which randomly drops
+// sync.Pool items and so defeats allocation tests.
+const raceEnabled = true
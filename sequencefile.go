@@ -1,8 +1,12 @@
 package hadoop
 
 import (
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
+	"os"
+	"sync"
 )
 
 import "fmt"
@@ -23,36 +27,104 @@ const (
 type sequenceFileReaderBlock struct {
 	numRecords     int
 	numReadRecords int
-	keyReader      io.Reader
-	keyLenReader   io.Reader
-	valueReader    io.Reader
-	valueLenReader io.Reader
+	keyReader      bytes.Reader
+	keyLenReader   bytes.Reader
+	valueReader    bytes.Reader
+	valueLenReader bytes.Reader
+
+	// buffers holds the uncompressed key length, key, value length and
+	// value buffers. They are reused for the next block.
+	buffers [4][]byte
 }
 
 type SequenceFileReader struct {
-	sync   []byte
-	reader io.Reader
-	block  *sequenceFileReaderBlock
-	codec  Codec
+	sync          []byte
+	reader        io.Reader
+	block         *sequenceFileReaderBlock
+	codec         Codec
+	compressed    []byte
+	maxBufferSize int
+	metadata      map[string]string
 }
 
 type sequenceFileWriterBlock struct {
 	parent         *SequenceFileWriter
+	index          int64
+	firstRecord    int64
 	numRecords     int
 	keyBuffer      bytes.Buffer
 	keyLenBuffer   bytes.Buffer
 	valueBuffer    bytes.Buffer
 	valueLenBuffer bytes.Buffer
+	compressed     [4][]byte
 }
 
 type SequenceFileWriter struct {
-	sync   []byte
-	writer io.Writer
-	block  *sequenceFileWriterBlock
-	codec  Codec
+	sync         []byte
+	writer       *countingWriter
+	block        *sequenceFileWriterBlock
+	codec        Codec
+	pipeline     *sequenceFileWriterPipeline
+	numBlocks    int64
+	numRecords   int64
+	onBlockFlush func(BlockInfo)
+	closer       io.Closer
+	freeBlocks   sync.Pool
+	closed       bool
+	closeErr     error
+
+	// header and selector are set while CodecSelection holds back the
+	// first blocks. The header is written once the codec is chosen.
+	header   *sequenceFileHeader
+	selector *codecSelector
 }
 
+type sequenceFileHeader struct {
+	keyClassName   string
+	valueClassName string
+	codecClassName string
+	metadata       map[string]string
+}
+
+// BlockInfo describes a block flushed by a SequenceFileWriter.
+type BlockInfo struct {
+	Index       int64 // ordinal of the block in the file
+	Offset      int64 // byte offset of the sync marker preceding the block
+	Length      int64 // number of bytes written for the block, including the sync marker
+	FirstRecord int64 // ordinal of the first record in the block
+	NumRecords  int
+}
+
+// RecordPosition tells where a record passed to SequenceFileWriter.Append
+// ended up. The byte offset of the block is reported to
+// SequenceFileWriterOpts.OnBlockFlush once the block is written.
+type RecordPosition struct {
+	Block        int64 // ordinal of the block holding the record
+	Record       int64 // ordinal of the record in the file
+	IndexInBlock int   // ordinal of the record within its block
+}
+
+// DEFAULT_MAX_BUFFER_SIZE is the MaxBufferSize of NewSequenceFileReader. It is
+// far above what Hadoop writes unless single records are that large.
+const DEFAULT_MAX_BUFFER_SIZE = 256 * 1024 * 1024
+
+type SequenceFileReaderOpts struct {
+	// MaxBufferSize limits the decompressed size of each of the key length,
+	// key, value length and value buffers of a block. Reading a block that
+	// exceeds it fails with a *DecompressionLimitError instead of exhausting
+	// memory. Zero means no limit.
+	MaxBufferSize int
+}
+
+// NewSequenceFileReader reads with a MaxBufferSize of DEFAULT_MAX_BUFFER_SIZE.
 func NewSequenceFileReader(r io.Reader) (*SequenceFileReader, error) {
+	return NewSequenceFileReaderWithOpts(r, &SequenceFileReaderOpts{MaxBufferSize: DEFAULT_MAX_BUFFER_SIZE})
+}
+
+func NewSequenceFileReaderWithOpts(r io.Reader, opts *SequenceFileReaderOpts) (*SequenceFileReader, error) {
+	if opts.MaxBufferSize < 0 {
+		return nil, fmt.Errorf("max buffer size must not be negative")
+	}
 	var magic [3]byte
 	if _, err := io.ReadFull(r, magic[:]); err != nil {
 		return nil, err
@@ -105,28 +177,35 @@ func NewSequenceFileReader(r io.Reader) (*SequenceFileReader, error) {
 		if version[0] >= VERSION_CUSTOM_COMPRESS {
 			var codecClassName TextWritable
 			codecClassName.Read(r)
-			var ok bool
-			codec, ok = Codecs[string(codecClassName.Buf)]
+			info, ok := LookupCodec(string(codecClassName.Buf))
 			if !ok {
-				return nil, fmt.Errorf("unsupported codec")
+				return nil, fmt.Errorf("unsupported codec %s", string(codecClassName.Buf))
 			}
+			codec = info.Codec
 			// fmt.Println("codecClassName =", string(codecClassName.Buf))
 		} else {
 			return nil, fmt.Errorf("not implemented")
 		}
 	}
 
-	var metadata map[string]string
+	metadata := map[string]string{}
 	if version[0] >= VERSION_WITH_METADATA {
 		size, err := ReadInt(r)
 		if err != nil {
 			return nil, err
 		}
+		if size < 0 {
+			return nil, fmt.Errorf("negative metadata size %d", size)
+		}
 		for i := 0; i < int(size); i++ {
 			var key TextWritable
 			var value TextWritable
-			key.Read(r)
-			value.Read(r)
+			if err := key.Read(r); err != nil {
+				return nil, err
+			}
+			if err := value.Read(r); err != nil {
+				return nil, err
+			}
 			metadata[string(key.Buf)] = string(value.Buf)
 		}
 	}
@@ -141,12 +220,20 @@ func NewSequenceFileReader(r io.Reader) (*SequenceFileReader, error) {
 	}
 
 	return &SequenceFileReader{
-		sync:   sync,
-		reader: r,
-		codec:  codec,
+		sync:          sync,
+		reader:        r,
+		codec:         codec,
+		maxBufferSize: opts.MaxBufferSize,
+		metadata:      metadata,
 	}, nil
 }
 
+// Metadata returns the metadata of the file header, which is empty for files
+// older than VERSION_WITH_METADATA. The map must not be modified.
+func (self *SequenceFileReader) Metadata() map[string]string {
+	return self.metadata
+}
+
 func (self *SequenceFileReader) readBlock() (*sequenceFileReaderBlock, error) {
 	if self.sync != nil {
 		ReadInt(self.reader)
@@ -163,71 +250,32 @@ func (self *SequenceFileReader) readBlock() (*sequenceFileReaderBlock, error) {
 	if err != nil {
 		return nil, err
 	}
-	// fmt.Println("numRecords =", numRecords)
-
-	keyLenBuffer, err := ReadBuffer(self.reader)
-	if err != nil {
-		return nil, err
-	}
-	// fmt.Println("len(keyLenBuffer) =", len(keyLenBuffer))
-
-	// fw, err := os.Create("keylenbuf.lz4")
-	// fw.Write(keyLenBuffer)
-	// fw.Close()
-
-	// fmt.Println("keylenbuf = [", keyLenBuffer[:18], "...]")
-	keyLenReader, err := self.codec.Uncompress(nil, keyLenBuffer)
-	if err != nil {
-		return nil, err
-	}
 
-	keyBuffer, err := ReadBuffer(self.reader)
-	if err != nil {
-		return nil, err
-	}
-	// fmt.Println("len(keyBuffer) =", len(keyBuffer))
-	// f2, _ := os.Create("keybuf.lz4")
-	// f2.Write(keyBuffer)
-	// f2.Close()
-
-	keyReader, err := self.codec.Uncompress(nil, keyBuffer)
-	if err != nil {
-		return nil, err
-	}
-
-	valueLenBuffer, err := ReadBuffer(self.reader)
-	if err != nil {
-		return nil, err
-	}
-	// fmt.Println("len(valueLenBuffer) =", len(valueLenBuffer))
-	valueLenReader, err := self.codec.Uncompress(nil, valueLenBuffer)
-	if err != nil {
-		return nil, err
+	// the previous block has been read to the end, so its buffers are free
+	block := self.block
+	if block == nil {
+		block = &sequenceFileReaderBlock{}
 	}
+	block.numRecords = 0
+	block.numReadRecords = 0
 
-	valueBuffer, err := ReadBuffer(self.reader)
-	if err != nil {
-		return nil, err
-	}
-	// fmt.Println("len(valueBuffer) =", len(valueBuffer))
-	valueReader, err := self.codec.Uncompress(nil, valueBuffer)
-	// fmt.Println("valueBuf = [", valueReader[:18], "...]")
-	if err != nil {
-		return nil, err
+	for i := range block.buffers {
+		self.compressed, err = readBufferInto(self.reader, self.compressed[:0])
+		if err != nil {
+			return nil, err
+		}
+		block.buffers[i], err = UncompressLimit(self.codec, block.buffers[i][:0], self.compressed, self.maxBufferSize)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// fp := self.reader.(*os.File)
-
-	// pos, _ := fp.Seek(0, os.SEEK_CUR)
-	// fmt.Println(pos)
-
-	return &sequenceFileReaderBlock{
-		numRecords:     int(numRecords),
-		keyReader:      bytes.NewReader(keyReader),
-		keyLenReader:   bytes.NewReader(keyLenReader),
-		valueReader:    bytes.NewReader(valueReader),
-		valueLenReader: bytes.NewReader(valueLenReader),
-	}, nil
+	block.numRecords = int(numRecords)
+	block.keyLenReader.Reset(block.buffers[0])
+	block.keyReader.Reset(block.buffers[1])
+	block.valueLenReader.Reset(block.buffers[2])
+	block.valueReader.Reset(block.buffers[3])
+	return block, nil
 }
 
 func (block *sequenceFileReaderBlock) Close() error {
@@ -253,7 +301,7 @@ func (self *SequenceFileReader) Read(key Writable, value Writable) error {
 			return err
 		}
 		self.block = newBlock
-		if oldBlock != nil {
+		if oldBlock != nil && oldBlock != newBlock {
 			oldBlock.Close() // TODO: handle error
 		}
 	}
@@ -273,89 +321,234 @@ func (block *sequenceFileReaderBlock) read(key Writable, value Writable) error {
 	if block.isEof() {
 		return io.EOF
 	}
-	key.Read(block.keyReader)
-	value.Read(block.valueReader)
+	key.Read(&block.keyReader)
+	value.Read(&block.valueReader)
 	block.numReadRecords++
 	return nil
 }
 
 type SequenceFileWriterOpts struct {
-	KeyClassName     string
-	ValueClassName   string
+	KeyClassName   string
+	ValueClassName string
+
+	// CompressionCodec is a codec class name or alias understood by
+	// LookupCodec. It defaults to DefaultCodec.
 	CompressionCodec string
+
+	// CodecOptions configures the compression codec for this writer only.
+	CodecOptions CodecOptions
+
+	// CompressionWorkers is the number of goroutines compressing finished
+	// blocks in parallel. Blocks are still written in order. Zero compresses
+	// blocks on the goroutine calling Write. The codec must be safe for
+	// concurrent use when this is greater than zero.
+	CompressionWorkers int
+
+	// CompressionQueueSize bounds the number of finished blocks waiting to be
+	// compressed or written. Write blocks once the queue is full. Defaults to
+	// twice CompressionWorkers.
+	CompressionQueueSize int
+
+	// OnBlockFlush, if set, is called after each block has been written to
+	// the underlying writer. With CompressionWorkers it is called from a
+	// background goroutine, still in block order.
+	OnBlockFlush func(BlockInfo)
+
+	// Metadata is written to the file header, as SequenceFile.Metadata.
+	Metadata map[string]string
+
+	// CodecSelection, if set, picks the codec by sampling the first blocks
+	// instead of using CompressionCodec, and records the decision in the
+	// metadata. CompressionCodec is still used for files without records.
+	// CodecOptions must be zero.
+	CodecSelection *CodecSelection
+
+	// Sync is the SYNC_HASH_SIZE byte sync marker to write between blocks.
+	// A random one is generated if nil. Set it, e.g. with SyncFromSeed, to
+	// make the output reproducible.
+	Sync []byte
 }
 
-func NewSequenceFileWriter(w io.Writer, opts *SequenceFileWriterOpts) (*SequenceFileWriter, error) {
-	if _, err := w.Write(SEQ_MAGIC[:]); err != nil {
-		return nil, err
+// SyncFromSeed derives a sync marker from seed. The same seed always yields
+// the same marker.
+func SyncFromSeed(seed int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(seed))
+	sum := md5.Sum(buf[:])
+	return sum[:]
+}
+
+func NewSequenceFileWriter(output io.Writer, opts *SequenceFileWriterOpts) (*SequenceFileWriter, error) {
+	header := &sequenceFileHeader{
+		keyClassName:   opts.KeyClassName,
+		valueClassName: opts.ValueClassName,
+		metadata:       map[string]string{},
 	}
-	var version = [...]byte{VERSION_CUSTOM_COMPRESS}
-	if _, err := w.Write(version[:]); err != nil {
-		return nil, err
+	if header.keyClassName == "" {
+		header.keyClassName = "org.apache.hadoop.io.Text"
+	}
+	if header.valueClassName == "" {
+		header.valueClassName = "org.apache.hadoop.io.BytesWritable"
+	}
+	for key, value := range opts.Metadata {
+		header.metadata[key] = value
 	}
 
-	var keyClassName TextWritable
-	if opts.KeyClassName == "" {
-		keyClassName.Buf = []byte("org.apache.hadoop.io.Text")
+	var codecName string
+	if opts.CompressionCodec == "" {
+		codecName = "org.apache.hadoop.io.compress.DefaultCodec"
 	} else {
-		keyClassName.Buf = []byte(opts.KeyClassName)
+		codecName = opts.CompressionCodec
+	}
+	info, ok := LookupCodec(codecName)
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %s", codecName)
+	}
+
+	sync := make([]byte, SYNC_HASH_SIZE)
+	if opts.Sync != nil {
+		if len(opts.Sync) != SYNC_HASH_SIZE {
+			return nil, fmt.Errorf("sync must be %d bytes long", SYNC_HASH_SIZE)
+		}
+		copy(sync, opts.Sync)
+	} else {
+		if _, err := rand.Read(sync); err != nil {
+			return nil, err
+		}
 	}
-	var valueClassName TextWritable
-	if opts.KeyClassName == "" {
-		valueClassName.Buf = []byte("org.apache.hadoop.io.BytesWritable")
+
+	writer := &SequenceFileWriter{
+		sync:         sync,
+		writer:       &countingWriter{writer: output},
+		onBlockFlush: opts.OnBlockFlush,
+	}
+	if opts.CodecSelection != nil {
+		if opts.CodecOptions != (CodecOptions{}) {
+			return nil, fmt.Errorf("codec options cannot be combined with codec selection")
+		}
+		selector, err := newCodecSelector(opts.CodecSelection, info)
+		if err != nil {
+			return nil, err
+		}
+		writer.header = header
+		writer.selector = selector
 	} else {
-		valueClassName.Buf = []byte(opts.KeyClassName)
+		codec, err := ConfigureCodec(info.Codec, opts.CodecOptions)
+		if err != nil {
+			return nil, err
+		}
+		writer.codec = codec
+		header.codecClassName = info.ClassName
+		if err := header.write(writer.writer, sync); err != nil {
+			return nil, err
+		}
+	}
+	if opts.CompressionWorkers > 0 {
+		writer.pipeline = newSequenceFileWriterPipeline(writer, opts.CompressionWorkers, opts.CompressionQueueSize)
+	}
+	return writer, nil
+}
+
+// write writes the file header, up to and including the sync marker. Files
+// with metadata are written as VERSION_WITH_METADATA.
+func (self *sequenceFileHeader) write(w io.Writer, sync []byte) error {
+	if _, err := w.Write(SEQ_MAGIC[:]); err != nil {
+		return err
+	}
+	var version = [...]byte{VERSION_CUSTOM_COMPRESS}
+	if len(self.metadata) > 0 {
+		version[0] = VERSION_WITH_METADATA
+	}
+	if _, err := w.Write(version[:]); err != nil {
+		return err
+	}
+
+	for _, name := range []string{self.keyClassName, self.valueClassName} {
+		if _, err := WriteBuffer(w, []byte(name)); err != nil {
+			return err
+		}
 	}
-	keyClassName.Write(w)
-	valueClassName.Write(w)
 
 	// uncompressed not supported yet
 
 	var compressed = true
-	var err error
-	err = WriteBoolean(w, compressed)
-	if err != nil {
-		return nil, err
+	if err := WriteBoolean(w, compressed); err != nil {
+		return err
 	}
-
 	var blockCompressed = true
-	err = WriteBoolean(w, blockCompressed)
-	if err != nil {
-		return nil, err
+	if err := WriteBoolean(w, blockCompressed); err != nil {
+		return err
+	}
+	if _, err := WriteBuffer(w, []byte(self.codecClassName)); err != nil {
+		return err
 	}
 
-	var codec Codec
-	var codecName string
-	if opts.CompressionCodec == "" {
-		codecName = "org.apache.hadoop.io.compress.DefaultCodec"
-	} else {
-		codecName = opts.CompressionCodec
+	if version[0] >= VERSION_WITH_METADATA {
+		if err := WriteInt(w, int32(len(self.metadata))); err != nil {
+			return err
+		}
+		for _, key := range sortedKeys(self.metadata) {
+			if _, err := WriteBuffer(w, []byte(key)); err != nil {
+				return err
+			}
+			if _, err := WriteBuffer(w, []byte(self.metadata[key])); err != nil {
+				return err
+			}
+		}
 	}
-	var ok bool
-	codec, ok = Codecs[codecName]
-	if !ok {
-		return nil, fmt.Errorf("unsupported codec")
+
+	_, err := w.Write(sync)
+	return err
+}
+
+// selectCodec picks the codec from the blocks held back by the selector,
+// writes the header and then the held back blocks.
+func (self *SequenceFileWriter) selectCodec() error {
+	info, metadata, err := self.selector.choose()
+	blocks := self.selector.blocks
+	self.selector = nil
+	if err != nil {
+		return err
 	}
-	var codecClassName TextWritable
-	codecClassName.Buf = []byte(codecName)
-	codecClassName.Write(w)
+	self.codec = info.Codec
+	self.header.codecClassName = info.ClassName
+	for key, value := range metadata {
+		self.header.metadata[key] = value
+	}
+	if err := self.header.write(self.writer, self.sync); err != nil {
+		return err
+	}
+	self.header = nil
 
-	// metadata not supported yet
+	for _, block := range blocks {
+		if self.pipeline != nil {
+			if err := self.pipeline.submit(block); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := block.Close(); err != nil {
+			return err
+		}
+		self.releaseBlock(block)
+	}
+	return nil
+}
 
-	sync := make([]byte, SYNC_HASH_SIZE)
-	_, err = rand.Read(sync)
+// CreateSequenceFile creates or truncates the named file and returns a writer
+// for it. Closing the writer also closes the file.
+func CreateSequenceFile(path string, opts *SequenceFileWriterOpts) (*SequenceFileWriter, error) {
+	fp, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := w.Write(sync); err != nil {
+	writer, err := NewSequenceFileWriter(fp, opts)
+	if err != nil {
+		fp.Close()
 		return nil, err
 	}
-
-	return &SequenceFileWriter{
-		sync:   sync,
-		writer: w,
-		codec:  codec,
-	}, nil
+	writer.closer = fp
+	return writer, nil
 }
 
 func (block *sequenceFileWriterBlock) Close() error {
@@ -363,45 +556,138 @@ func (block *sequenceFileWriterBlock) Close() error {
 		return nil
 	}
 
-	if block.parent.sync != nil {
-		WriteInt(block.parent.writer, -1) // XXX what is this???
-		if _, err := block.parent.writer.Write(block.parent.sync); err != nil {
-			return err
-		}
-	}
-
-	_, err := WriteVLong(block.parent.writer, int64(block.numRecords))
+	buffers, err := block.compress()
 	if err != nil {
 		return err
 	}
+	return block.parent.writeBlock(block, buffers)
+}
 
-	buffers := []*bytes.Buffer{
+// compress returns the compressed key length, key, value length and value
+// buffers of the block, in the order they appear in the file. The returned
+// buffers are only valid until the block is reused.
+func (block *sequenceFileWriterBlock) compress() ([][]byte, error) {
+	buffers := [...]*bytes.Buffer{
 		&block.keyLenBuffer,
 		&block.keyBuffer,
 		&block.valueLenBuffer,
 		&block.valueBuffer,
 	}
-
-	for _, buffer := range buffers {
-		compressedBuf, err := block.parent.codec.Compress(nil, buffer.Bytes())
-		if err != nil {
-			return err
-		}
-		_, err = WriteBuffer(block.parent.writer, compressedBuf)
+	for i, buffer := range buffers {
+		compressed, err := block.parent.codec.Compress(block.compressed[i][:0], buffer.Bytes())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		block.compressed[i] = compressed
 	}
+	return block.compressed[:], nil
+}
 
+// newBlock returns an empty block, reusing the buffers of a block that has
+// already been written if there is one.
+func (self *SequenceFileWriter) newBlock() *sequenceFileWriterBlock {
+	block, _ := self.freeBlocks.Get().(*sequenceFileWriterBlock)
+	if block == nil {
+		block = &sequenceFileWriterBlock{parent: self}
+	}
+	block.index = self.numBlocks
+	block.firstRecord = self.numRecords
+	self.numBlocks++
+	return block
+}
+
+func (self *SequenceFileWriter) releaseBlock(block *sequenceFileWriterBlock) {
 	block.numRecords = 0
 	block.keyLenBuffer.Reset()
 	block.keyBuffer.Reset()
 	block.valueLenBuffer.Reset()
 	block.valueBuffer.Reset()
+	self.freeBlocks.Put(block)
+}
+
+func (self *SequenceFileWriter) writeBlock(block *sequenceFileWriterBlock, buffers [][]byte) error {
+	offset := self.writer.Offset()
+	if self.sync != nil {
+		WriteInt(self.writer, -1) // XXX what is this???
+		if _, err := self.writer.Write(self.sync); err != nil {
+			return err
+		}
+	}
+
+	_, err := WriteVLong(self.writer, int64(block.numRecords))
+	if err != nil {
+		return err
+	}
+
+	for _, buffer := range buffers {
+		_, err = WriteBuffer(self.writer, buffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.onBlockFlush != nil {
+		self.onBlockFlush(BlockInfo{
+			Index:       block.index,
+			Offset:      offset,
+			Length:      self.writer.Offset() - offset,
+			FirstRecord: block.firstRecord,
+			NumRecords:  block.numRecords,
+		})
+	}
 	return nil
 }
 
+// Offset returns the number of bytes written to the underlying writer so far.
+// Records still buffered in the current block, or queued for compression, are
+// not included. Nothing is written while CodecSelection holds back blocks.
+func (self *SequenceFileWriter) Offset() int64 {
+	return self.writer.Offset()
+}
+
+// Close flushes the last block. If the writer was created by
+// CreateSequenceFile, the file is closed as well. Closing again returns the
+// result of the first Close.
 func (self *SequenceFileWriter) Close() error {
+	if self.closed {
+		return self.closeErr
+	}
+	self.closed = true
+	err := self.flush()
+	if self.closer != nil {
+		if closeErr := self.closer.Close(); err == nil {
+			err = closeErr
+		}
+		self.closer = nil
+	}
+	self.closeErr = err
+	return err
+}
+
+func (self *SequenceFileWriter) flush() error {
+	if self.selector != nil {
+		if self.block != nil && self.block.numRecords > 0 {
+			self.selector.add(self.block)
+		}
+		self.block = nil
+		if err := self.selectCodec(); err != nil {
+			if self.pipeline != nil {
+				self.pipeline.close()
+			}
+			return err
+		}
+	}
+	if self.pipeline != nil {
+		var err error
+		if self.block != nil && self.block.numRecords > 0 {
+			err = self.pipeline.submit(self.block)
+		}
+		self.block = nil
+		if closeErr := self.pipeline.close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
 	if self.block != nil {
 		err := self.block.Close()
 		self.block = nil
@@ -413,23 +699,47 @@ func (self *SequenceFileWriter) Close() error {
 }
 
 func (self *SequenceFileWriter) Write(key Writable, value Writable) error {
+	_, err := self.Append(key, value)
+	return err
+}
+
+// Append writes a record like Write and returns where the record ended up.
+func (self *SequenceFileWriter) Append(key Writable, value Writable) (RecordPosition, error) {
+	if self.closed {
+		return RecordPosition{}, fmt.Errorf("write to closed writer")
+	}
 	for self.block == nil || self.block.isBigEnough() {
-		if self.block != nil {
+		if self.block != nil && self.selector != nil {
+			if self.selector.add(self.block) {
+				if err := self.selectCodec(); err != nil {
+					return RecordPosition{}, err
+				}
+			}
+		} else if self.block != nil && self.pipeline != nil {
+			if err := self.pipeline.submit(self.block); err != nil {
+				return RecordPosition{}, err
+			}
+		} else if self.block != nil {
 			err := self.block.Close()
 			if err != nil {
-				return err
+				return RecordPosition{}, err
 			}
+			self.releaseBlock(self.block)
 		}
-		self.block = &sequenceFileWriterBlock{
-			parent: self,
-		}
+		self.block = self.newBlock()
 	}
 
+	position := RecordPosition{
+		Block:        self.block.index,
+		Record:       self.numRecords,
+		IndexInBlock: self.block.numRecords,
+	}
 	err := self.block.write(key, value)
 	if err != nil {
-		return err
+		return RecordPosition{}, err
 	}
-	return nil
+	self.numRecords++
+	return position, nil
 }
 
 func (block *sequenceFileWriterBlock) isBigEnough() bool {
@@ -0,0 +1,58 @@
+package hadoop
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// HashPartition returns the partition of key the way Hadoop's HashPartitioner
+// does: (key.hashCode() & Integer.MAX_VALUE) % numPartitions.
+func HashPartition(key Hashable, numPartitions int) int {
+	return int((key.HashCode() & 0x7fffffff) % int32(numPartitions))
+}
+
+// PartitionedSequenceFileWriter writes records into part-r-NNNNN files, routing
+// each key with HashPartition so that the output is co-partitioned with
+// MapReduce jobs using the same number of reducers.
+type PartitionedSequenceFileWriter struct {
+	writers []*SequenceFileWriter
+}
+
+// NewPartitionedSequenceFileWriter creates one file per partition in dir. Like
+// Hadoop, every partition file is created up front, even if it ends up empty.
+func NewPartitionedSequenceFileWriter(dir string, numPartitions int, opts *SequenceFileWriterOpts) (*PartitionedSequenceFileWriter, error) {
+	if numPartitions <= 0 {
+		return nil, fmt.Errorf("number of partitions must be positive")
+	}
+	self := &PartitionedSequenceFileWriter{}
+	for i := 0; i < numPartitions; i++ {
+		writer, err := CreateSequenceFile(filepath.Join(dir, fmt.Sprintf("part-r-%05d", i)), opts)
+		if err != nil {
+			self.Close()
+			return nil, err
+		}
+		self.writers = append(self.writers, writer)
+	}
+	return self, nil
+}
+
+// Write appends the record to the partition of key, which must implement
+// Hashable.
+func (self *PartitionedSequenceFileWriter) Write(key Writable, value Writable) error {
+	hashable, ok := key.(Hashable)
+	if !ok {
+		return fmt.Errorf("key %T does not implement Hashable", key)
+	}
+	return self.writers[HashPartition(hashable, len(self.writers))].Write(key, value)
+}
+
+func (self *PartitionedSequenceFileWriter) Close() error {
+	var err error
+	for _, writer := range self.writers {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	self.writers = nil
+	return err
+}
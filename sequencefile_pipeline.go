@@ -0,0 +1,113 @@
+package hadoop
+
+import (
+	"fmt"
+	"sync"
+)
+
+// sequenceFileWriterPipeline compresses finished blocks on a pool of worker
+// goroutines and writes them to the underlying writer in submission order.
+type sequenceFileWriterPipeline struct {
+	parent  *SequenceFileWriter
+	jobs    chan *sequenceFileWriterJob
+	ordered chan *sequenceFileWriterJob
+	workers sync.WaitGroup
+	flushed chan struct{}
+	closed  bool
+
+	mutex sync.Mutex
+	err   error
+}
+
+type sequenceFileWriterJob struct {
+	block   *sequenceFileWriterBlock
+	buffers [][]byte
+	err     error
+	done    chan struct{}
+}
+
+func newSequenceFileWriterPipeline(parent *SequenceFileWriter, numWorkers int, queueSize int) *sequenceFileWriterPipeline {
+	if queueSize <= 0 {
+		queueSize = 2 * numWorkers
+	}
+	p := &sequenceFileWriterPipeline{
+		parent:  parent,
+		jobs:    make(chan *sequenceFileWriterJob, queueSize),
+		ordered: make(chan *sequenceFileWriterJob, queueSize),
+		flushed: make(chan struct{}),
+	}
+	for i := 0; i < numWorkers; i++ {
+		p.workers.Add(1)
+		go p.compressLoop()
+	}
+	go p.writeLoop()
+	return p
+}
+
+func (p *sequenceFileWriterPipeline) compressLoop() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		job.buffers, job.err = job.block.compress()
+		close(job.done)
+	}
+}
+
+func (p *sequenceFileWriterPipeline) writeLoop() {
+	defer close(p.flushed)
+	for job := range p.ordered {
+		<-job.done
+		err := job.err
+		if err == nil && p.error() == nil {
+			err = p.parent.writeBlock(job.block, job.buffers)
+		}
+		p.parent.releaseBlock(job.block)
+		if err != nil {
+			p.setError(err)
+		}
+	}
+}
+
+func (p *sequenceFileWriterPipeline) error() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.err
+}
+
+func (p *sequenceFileWriterPipeline) setError(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// submit queues a finished block, blocking while the queue is full. It
+// returns the first error hit by an earlier block, if any.
+func (p *sequenceFileWriterPipeline) submit(block *sequenceFileWriterBlock) error {
+	if p.closed {
+		return fmt.Errorf("write to closed writer")
+	}
+	if err := p.error(); err != nil {
+		return err
+	}
+	job := &sequenceFileWriterJob{
+		block: block,
+		done:  make(chan struct{}),
+	}
+	p.ordered <- job
+	p.jobs <- job
+	return nil
+}
+
+// close waits for all queued blocks to be written and stops the goroutines.
+func (p *sequenceFileWriterPipeline) close() error {
+	if p.closed {
+		return p.error()
+	}
+	p.closed = true
+	close(p.jobs)
+	close(p.ordered)
+	<-p.flushed
+	p.workers.Wait()
+	return p.error()
+}
@@ -0,0 +1,195 @@
+package hadoop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type RollingSequenceFileWriterOpts struct {
+	WriterOpts *SequenceFileWriterOpts
+
+	// Files are named <Dir>/<Prefix>.<counter><Suffix>, where the counter
+	// starts at the creation time of the writer in milliseconds and is
+	// incremented for each file. Prefix defaults to "data" and Suffix to
+	// ".seq". Set Path to choose the names instead.
+	Dir    string
+	Prefix string
+	Suffix string
+
+	// Path, if set, returns the final path of the n-th file, opened at t.
+	// Missing parent directories are created.
+	Path func(t time.Time, n int) string
+
+	// InProgressSuffix is appended to the path of the file being written.
+	// The file is renamed to its final path when it is rolled. Defaults to
+	// ".tmp".
+	InProgressSuffix string
+
+	// A new file is started once the current one reaches MaxBytes bytes,
+	// MaxRecords records, or is older than MaxAge. Zero disables the limit.
+	// The size only counts flushed blocks, so files may exceed MaxBytes by
+	// up to one block. The age is checked on Write; call Roll from a timer
+	// to close idle files on time.
+	MaxBytes   int64
+	MaxRecords int64
+	MaxAge     time.Duration
+
+	// OnRoll, if set, is called with the final path of each finished file.
+	// If a Write rolls the file after writing its record, an error from
+	// OnRoll is returned by the next Write, Roll or Close instead, as the
+	// record was written.
+	OnRoll func(path string) error
+}
+
+// RollingSequenceFileWriter writes records to a sequence of SequenceFiles,
+// starting a new file whenever the current one hits one of the limits in
+// RollingSequenceFileWriterOpts. It is safe for concurrent use.
+type RollingSequenceFileWriter struct {
+	opts    RollingSequenceFileWriterOpts
+	counter int64
+	n       int
+
+	mutex      sync.Mutex
+	writer     *SequenceFileWriter
+	path       string
+	openedAt   time.Time
+	numRecords int64
+	rollErr    error // from OnRoll, for the next call to return
+}
+
+func NewRollingSequenceFileWriter(opts *RollingSequenceFileWriterOpts) (*RollingSequenceFileWriter, error) {
+	if opts.MaxBytes < 0 || opts.MaxRecords < 0 || opts.MaxAge < 0 {
+		return nil, fmt.Errorf("negative roll limit")
+	}
+	self := &RollingSequenceFileWriter{
+		opts:    *opts,
+		counter: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if self.opts.WriterOpts == nil {
+		self.opts.WriterOpts = &SequenceFileWriterOpts{}
+	}
+	if self.opts.Prefix == "" {
+		self.opts.Prefix = "data"
+	}
+	if self.opts.Suffix == "" {
+		self.opts.Suffix = ".seq"
+	}
+	if self.opts.InProgressSuffix == "" {
+		self.opts.InProgressSuffix = ".tmp"
+	}
+	return self, nil
+}
+
+func (self *RollingSequenceFileWriter) Write(key Writable, value Writable) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if err := self.rollErr; err != nil {
+		self.rollErr = nil
+		return err
+	}
+	if self.writer != nil && self.opts.MaxAge > 0 && time.Since(self.openedAt) >= self.opts.MaxAge {
+		if err := self.roll(); err != nil {
+			return err
+		}
+	}
+	if self.writer == nil {
+		if err := self.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := self.writer.Write(key, value); err != nil {
+		return err
+	}
+	self.numRecords++
+
+	if (self.opts.MaxRecords > 0 && self.numRecords >= self.opts.MaxRecords) ||
+		(self.opts.MaxBytes > 0 && self.writer.Offset() >= self.opts.MaxBytes) {
+		path, err := self.finish()
+		if err != nil {
+			return err
+		}
+		self.rollErr = self.onRoll(path)
+	}
+	return nil
+}
+
+// Roll finishes the current file, if any. The next Write starts a new one.
+func (self *RollingSequenceFileWriter) Roll() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	err := self.roll()
+	if err == nil {
+		err = self.rollErr
+	}
+	self.rollErr = nil
+	return err
+}
+
+// Close finishes the current file, if any.
+func (self *RollingSequenceFileWriter) Close() error {
+	return self.Roll()
+}
+
+func (self *RollingSequenceFileWriter) open() error {
+	now := time.Now()
+	var path string
+	if self.opts.Path != nil {
+		path = self.opts.Path(now, self.n)
+	} else {
+		name := fmt.Sprintf("%s.%d%s", self.opts.Prefix, self.counter+int64(self.n), self.opts.Suffix)
+		path = filepath.Join(self.opts.Dir, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	writer, err := CreateSequenceFile(path+self.opts.InProgressSuffix, self.opts.WriterOpts)
+	if err != nil {
+		return err
+	}
+	self.n++
+	self.writer = writer
+	self.path = path
+	self.openedAt = now
+	self.numRecords = 0
+	return nil
+}
+
+func (self *RollingSequenceFileWriter) roll() error {
+	path, err := self.finish()
+	if err != nil {
+		return err
+	}
+	return self.onRoll(path)
+}
+
+// finish closes the current file, if any, and moves it to its final path,
+// which it returns.
+func (self *RollingSequenceFileWriter) finish() (string, error) {
+	if self.writer == nil {
+		return "", nil
+	}
+	writer, path := self.writer, self.path
+	self.writer = nil
+	self.path = ""
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+self.opts.InProgressSuffix, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (self *RollingSequenceFileWriter) onRoll(path string) error {
+	if path == "" || self.opts.OnRoll == nil {
+		return nil
+	}
+	return self.opts.OnRoll(path)
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -81,13 +84,24 @@ func genTestData(seed int) (string, string) {
 // Write a sequence file filled with random data, then read it back and assert that the values read
 // match the values written.
 func TestWriteThenRead(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{})
+}
+
+// Same as TestWriteThenRead, but with blocks compressed by a pool of goroutines.
+func TestWriteThenReadParallel(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionWorkers:   4,
+		CompressionQueueSize: 2,
+	})
+}
+
+func testWriteThenRead(t *testing.T, writerOpts *SequenceFileWriterOpts) {
 	assert := assert.New(t)
 	NUM_RECORDS := 100
 
 	var key TextWritable
 	var value BytesWritable
 
-	writerOpts := &SequenceFileWriterOpts{}
 	buf := bytes.Buffer{}
 	writer, err := NewSequenceFileWriter(&buf, writerOpts)
 	assert.NoError(err)
@@ -100,6 +114,8 @@ func TestWriteThenRead(t *testing.T) {
 	}
 	err = writer.Close()
 	assert.NoError(err)
+	assert.EqualError(writer.Write(&key, &value), "write to closed writer")
+	assert.NoError(writer.Close())
 
 	// log.Printf("Sequence file is %d bytes long\n", buf.Len())
 
@@ -122,3 +138,477 @@ func TestWriteThenRead(t *testing.T) {
 	err = reader.Close()
 	assert.NoError(err)
 }
+
+// Blocks reported through OnBlockFlush must start at a sync marker and add up
+// to the whole file.
+func TestWriterOffsets(t *testing.T) {
+	assert := assert.New(t)
+
+	var blocks []BlockInfo
+	buf := bytes.Buffer{}
+	writer, err := NewSequenceFileWriter(&buf, &SequenceFileWriterOpts{
+		OnBlockFlush: func(info BlockInfo) {
+			blocks = append(blocks, info)
+		},
+	})
+	assert.NoError(err)
+	headerSize := writer.Offset()
+	assert.Equal(int64(buf.Len()), headerSize)
+
+	var key TextWritable
+	var value BytesWritable
+	var positions []RecordPosition
+	for i := 0; i < 10; i++ {
+		keyStr, valueStr := genTestData(i)
+		key.Buf = []byte(keyStr)
+		value.Buf = []byte(valueStr)
+		position, err := writer.Append(&key, &value)
+		assert.NoError(err)
+		assert.Equal(int64(i), position.Record)
+		positions = append(positions, position)
+	}
+	assert.NoError(writer.Close())
+	assert.Equal(int64(buf.Len()), writer.Offset())
+
+	if !assert.True(len(blocks) > 1) {
+		return
+	}
+	offset := headerSize
+	for i, block := range blocks {
+		assert.Equal(int64(i), block.Index)
+		assert.Equal(offset, block.Offset)
+		assert.Equal(writer.sync, buf.Bytes()[block.Offset+4:block.Offset+4+SYNC_HASH_SIZE])
+		offset += block.Length
+	}
+	assert.Equal(int64(buf.Len()), offset)
+
+	for _, position := range positions {
+		block := blocks[position.Block]
+		assert.Equal(block.FirstRecord+int64(position.IndexInBlock), position.Record)
+		assert.True(position.IndexInBlock < block.NumRecords)
+	}
+}
+
+func TestRollingWriter(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	var rolled []string
+	writer, err := NewRollingSequenceFileWriter(&RollingSequenceFileWriterOpts{
+		Dir:        dir,
+		MaxRecords: 3,
+		OnRoll: func(path string) error {
+			rolled = append(rolled, path)
+			return nil
+		},
+	})
+	assert.NoError(err)
+
+	var key LongWritable
+	var value BytesWritable
+	for i := 0; i < 7; i++ {
+		key = LongWritable(i)
+		value.Buf = []byte(fmt.Sprint(i))
+		assert.NoError(writer.Write(&key, &value))
+	}
+	assert.NoError(writer.Close())
+
+	assert.Equal(3, len(rolled))
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(err)
+	assert.Equal(rolled, matches)
+
+	i := 0
+	for _, path := range rolled {
+		fp, err := os.Open(path)
+		assert.NoError(err)
+		reader, err := NewSequenceFileReader(fp)
+		assert.NoError(err)
+		for {
+			if err := reader.Read(&key, &value); err != nil {
+				assert.Equal(io.EOF, err)
+				break
+			}
+			assert.Equal(LongWritable(i), key)
+			i++
+		}
+		fp.Close()
+	}
+	assert.Equal(7, i)
+}
+
+func TestRollingWriterOnRollError(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	rollErr := fmt.Errorf("upload failed")
+	var rolled []string
+	writer, err := NewRollingSequenceFileWriter(&RollingSequenceFileWriterOpts{
+		Dir:        dir,
+		MaxRecords: 1,
+		OnRoll: func(path string) error {
+			rolled = append(rolled, path)
+			return rollErr
+		},
+	})
+	assert.NoError(err)
+
+	// the record is written, so the error comes from the next call, which
+	// does not write its record
+	key := LongWritable(1)
+	value := BytesWritable{}
+	assert.NoError(writer.Write(&key, &value))
+	assert.Equal(1, len(rolled))
+	assert.Equal(rollErr, writer.Write(&key, &value))
+	assert.NoError(writer.Write(&key, &value))
+	assert.Equal(rollErr, writer.Close())
+	assert.NoError(writer.Close())
+
+	assert.Equal(2, len(rolled))
+	for _, path := range rolled {
+		fp, err := os.Open(path)
+		assert.NoError(err)
+		reader, err := NewSequenceFileReader(fp)
+		assert.NoError(err)
+		assert.NoError(reader.Read(&key, &value))
+		assert.Equal(io.EOF, reader.Read(&key, &value))
+		fp.Close()
+	}
+}
+
+func TestPartitionedWriter(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	writer, err := NewPartitionedSequenceFileWriter(dir, 3, &SequenceFileWriterOpts{})
+	assert.NoError(err)
+	var key TextWritable
+	var value BytesWritable
+	for i := 0; i < 20; i++ {
+		key.Buf = []byte(fmt.Sprint("key", i))
+		assert.NoError(writer.Write(&key, &value))
+	}
+	assert.NoError(writer.Close())
+
+	numRecords := 0
+	for partition := 0; partition < 3; partition++ {
+		fp, err := os.Open(filepath.Join(dir, fmt.Sprintf("part-r-0000%d", partition)))
+		if !assert.NoError(err) {
+			continue
+		}
+		reader, err := NewSequenceFileReader(fp)
+		assert.NoError(err)
+		for reader.Read(&key, &value) == nil {
+			assert.Equal(partition, HashPartition(&key, 3))
+			numRecords++
+		}
+		fp.Close()
+	}
+	assert.Equal(20, numRecords)
+}
+
+// Writers given the same sync marker must produce byte-identical files.
+func TestDeterministicSync(t *testing.T) {
+	assert := assert.New(t)
+
+	write := func(sync []byte) []byte {
+		buf := bytes.Buffer{}
+		writer, err := NewSequenceFileWriter(&buf, &SequenceFileWriterOpts{Sync: sync})
+		assert.NoError(err)
+		for i := 0; i < 3; i++ {
+			keyStr, valueStr := genTestData(i)
+			assert.NoError(writer.Write(&TextWritable{Buf: []byte(keyStr)}, &BytesWritable{Buf: []byte(valueStr)}))
+		}
+		assert.NoError(writer.Close())
+		return buf.Bytes()
+	}
+
+	assert.Equal(SyncFromSeed(42), SyncFromSeed(42))
+	assert.NotEqual(SyncFromSeed(42), SyncFromSeed(43))
+	assert.Equal(write(SyncFromSeed(42)), write(SyncFromSeed(42)))
+	assert.NotEqual(write(SyncFromSeed(42)), write(SyncFromSeed(43)))
+	assert.NotEqual(write(nil), write(nil))
+
+	_, err := NewSequenceFileWriter(&bytes.Buffer{}, &SequenceFileWriterOpts{Sync: []byte("short")})
+	assert.Error(err)
+}
+
+func TestWriteThenReadWithCodecOptions(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CodecOptions: CodecOptions{Level: 1},
+	})
+}
+
+func TestWriteThenReadLz4(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "org.apache.hadoop.io.compress.Lz4Codec",
+	})
+}
+
+func TestWriteThenReadSnappy(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "org.apache.hadoop.io.compress.SnappyCodec",
+	})
+}
+
+func TestWriteThenReadZStandard(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "org.apache.hadoop.io.compress.ZStandardCodec",
+		CodecOptions:     CodecOptions{Level: 5},
+	})
+}
+
+func TestWriteThenReadGzip(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "org.apache.hadoop.io.compress.GzipCodec",
+	})
+}
+
+func TestWriteThenReadBzip2(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "org.apache.hadoop.io.compress.BZip2Codec",
+	})
+}
+
+func TestWriteThenReadLzo(t *testing.T) {
+	testWriteThenRead(t, &SequenceFileWriterOpts{
+		CompressionCodec: "com.hadoop.compression.lzo.LzoCodec",
+	})
+}
+
+func TestSequenceFileCodecAlias(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	writer, err := NewSequenceFileWriter(&buf, &SequenceFileWriterOpts{
+		KeyClassName:     "org.apache.hadoop.io.BytesWritable",
+		ValueClassName:   "org.apache.hadoop.io.BytesWritable",
+		CompressionCodec: "gzip",
+	})
+	assert.NoError(err)
+	assert.NoError(writer.Write(&BytesWritable{Buf: []byte("key")}, &BytesWritable{Buf: []byte("value")}))
+	assert.NoError(writer.Close())
+	assert.True(bytes.Contains(buf.Bytes(), []byte("org.apache.hadoop.io.compress.GzipCodec")))
+
+	reader, err := NewSequenceFileReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	var key, value BytesWritable
+	assert.NoError(reader.Read(&key, &value))
+	assert.Equal("value", string(value.Buf))
+}
+
+func TestCodecSelection(t *testing.T) {
+	assert := assert.New(t)
+	data := genCompressibleData(3000)
+	genValue := func(i int) []byte {
+		return data[i%1000 : 1000+i%2000]
+	}
+	write := func(numRecords int, opts *SequenceFileWriterOpts) *SequenceFileReader {
+		var buf bytes.Buffer
+		writer, err := NewSequenceFileWriter(&buf, opts)
+		assert.NoError(err)
+		for i := 0; i < numRecords; i++ {
+			value := BytesWritable{Buf: genValue(i)}
+			assert.NoError(writer.Write(&BytesWritable{Buf: []byte(fmt.Sprint(i))}, &value))
+		}
+		assert.NoError(writer.Close())
+		reader, err := NewSequenceFileReader(&buf)
+		assert.NoError(err)
+		var key, value BytesWritable
+		for i := 0; i < numRecords; i++ {
+			assert.NoError(reader.Read(&key, &value))
+			assert.Equal(fmt.Sprint(i), string(key.Buf))
+			assert.True(bytes.Equal(genValue(i), value.Buf))
+		}
+		assert.Equal(io.EOF, reader.Read(&key, &value))
+		return reader
+	}
+
+	// about 4 blocks, so that blocks are held back and written afterwards
+	for _, workers := range []int{0, 2} {
+		var sampled []CodecSample
+		reader := write(3000, &SequenceFileWriterOpts{
+			Metadata:           map[string]string{"owner": "test"},
+			CompressionWorkers: workers,
+			CodecSelection: &CodecSelection{
+				Candidates:    []string{"snappy", "deflate", "lz4"},
+				SampleBlocks:  2,
+				RecordSamples: true,
+				Policy: func(samples []CodecSample) (int, error) {
+					sampled = samples
+					return 1, nil
+				},
+			},
+		})
+		if !assert.Equal(3, len(sampled)) {
+			continue
+		}
+		for _, sample := range sampled {
+			assert.True(sample.UncompressedSize > 2*BLOCK_SIZE_MIN)
+			assert.True(sample.Ratio() > 1)
+		}
+		assert.Equal("org.apache.hadoop.io.compress.SnappyCodec", sampled[0].Info.ClassName)
+
+		metadata := reader.Metadata()
+		assert.Equal("test", metadata["owner"])
+		assert.Equal("org.apache.hadoop.io.compress.DefaultCodec", metadata[CODEC_SELECTION_METADATA_KEY])
+		assert.Equal(sampled[0].String(), metadata[CODEC_SELECTION_METADATA_KEY+".org.apache.hadoop.io.compress.SnappyCodec"])
+		assert.Equal(5, len(metadata))
+		assert.IsType(&ZlibCodec{}, reader.codec)
+	}
+
+	// without RecordSamples, only the choice is recorded
+	reader := write(10, &SequenceFileWriterOpts{
+		CodecSelection: &CodecSelection{Candidates: []string{"lz4"}},
+	})
+	assert.Equal(map[string]string{
+		CODEC_SELECTION_METADATA_KEY: "org.apache.hadoop.io.compress.Lz4Codec",
+	}, reader.Metadata())
+
+	// by default, only codecs stock Hadoop reads are candidates
+	selector, err := newCodecSelector(&CodecSelection{}, CodecInfo{})
+	assert.NoError(err)
+	var candidates []string
+	for _, info := range selector.candidates {
+		candidates = append(candidates, info.ClassName)
+	}
+	assert.Equal(hadoopCodecs, candidates)
+
+	// without records, CompressionCodec is used
+	reader = write(0, &SequenceFileWriterOpts{
+		CompressionCodec: "gzip",
+		CodecSelection:   &CodecSelection{},
+	})
+	assert.Equal(map[string]string{
+		CODEC_SELECTION_METADATA_KEY: "org.apache.hadoop.io.compress.GzipCodec",
+	}, reader.Metadata())
+
+	_, err = NewSequenceFileWriter(&bytes.Buffer{}, &SequenceFileWriterOpts{
+		CodecOptions:   CodecOptions{Level: 1},
+		CodecSelection: &CodecSelection{},
+	})
+	assert.Error(err)
+	_, err = NewSequenceFileWriter(&bytes.Buffer{}, &SequenceFileWriterOpts{
+		CodecSelection: &CodecSelection{Candidates: []string{"nonexistent"}},
+	})
+	assert.Error(err)
+}
+
+func TestCodecPolicy(t *testing.T) {
+	assert := assert.New(t)
+	sample := func(compressedSize int64, compressTime time.Duration) CodecSample {
+		return CodecSample{UncompressedSize: 100 << 20, CompressedSize: compressedSize, CompressTime: compressTime}
+	}
+	samples := []CodecSample{
+		sample(50<<20, time.Second/4), // ratio 2, 400MB/s
+		sample(20<<20, time.Second),   // ratio 5, 100MB/s
+		sample(25<<20, time.Second/2), // ratio 4, 200MB/s
+	}
+	for _, c := range []struct {
+		policy CodecPolicy
+		chosen int
+	}{
+		{MaxRatioPolicy(0), 1},
+		{MaxRatioPolicy(150), 2},
+		{MaxRatioPolicy(300), 0},
+		{MaxRatioPolicy(1000), 0},
+		{MaxThroughputPolicy(0), 0},
+		{MaxThroughputPolicy(3), 2},
+		{MaxThroughputPolicy(10), 1},
+	} {
+		chosen, err := c.policy(samples)
+		assert.NoError(err)
+		assert.Equal(c.chosen, chosen)
+	}
+}
+
+func benchmarkSequenceFileData() []BytesWritable {
+	data := make([]BytesWritable, 1000)
+	for i := range data {
+		data[i].Buf = genCompressibleData(100 + i%1000)
+	}
+	return data
+}
+
+func BenchmarkSequenceFileWrite(b *testing.B) {
+	data := benchmarkSequenceFileData()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writer, err := NewSequenceFileWriter(ioutil.Discard, &SequenceFileWriterOpts{
+			KeyClassName:   "org.apache.hadoop.io.BytesWritable",
+			ValueClassName: "org.apache.hadoop.io.BytesWritable",
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			for k := range data {
+				if err := writer.Write(&data[k], &data[k]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := writer.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSequenceFileRead(b *testing.B) {
+	data := benchmarkSequenceFileData()
+	var buf bytes.Buffer
+	writer, err := NewSequenceFileWriter(&buf, &SequenceFileWriterOpts{
+		KeyClassName:   "org.apache.hadoop.io.BytesWritable",
+		ValueClassName: "org.apache.hadoop.io.BytesWritable",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for j := 0; j < 10; j++ {
+		for k := range data {
+			if err := writer.Write(&data[k], &data[k]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(buf.Len()))
+	for i := 0; i < b.N; i++ {
+		reader, err := NewSequenceFileReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var key, value BytesWritable
+		for {
+			if err := reader.Read(&key, &value); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSequenceFileReaderMaxBufferSize(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	writer, err := NewSequenceFileWriter(&buf, &SequenceFileWriterOpts{
+		KeyClassName:   "org.apache.hadoop.io.BytesWritable",
+		ValueClassName: "org.apache.hadoop.io.BytesWritable",
+	})
+	assert.NoError(err)
+	assert.NoError(writer.Write(&BytesWritable{Buf: []byte("key")}, &BytesWritable{Buf: make([]byte, 100000)}))
+	assert.NoError(writer.Close())
+
+	var key, value BytesWritable
+	reader, err := NewSequenceFileReaderWithOpts(bytes.NewReader(buf.Bytes()), &SequenceFileReaderOpts{MaxBufferSize: 100004})
+	assert.NoError(err)
+	assert.NoError(reader.Read(&key, &value))
+	assert.Equal(100000, len(value.Buf))
+
+	reader, err = NewSequenceFileReaderWithOpts(bytes.NewReader(buf.Bytes()), &SequenceFileReaderOpts{MaxBufferSize: 100003})
+	assert.NoError(err)
+	assert.Equal(&DecompressionLimitError{Limit: 100003}, reader.Read(&key, &value))
+}
@@ -1,13 +1,65 @@
 package hadoop
 
 import "io"
+import "bytes"
 import "encoding/binary"
+import "math"
 
 type Writable interface {
 	Write(w io.Writer) (int, error)
 	Read(r io.Reader) error
 }
 
+// Hashable is implemented by Writables whose HashCode matches hashCode() of
+// the corresponding Hadoop class, so that they partition like Java keys.
+type Hashable interface {
+	HashCode() int32
+}
+
+// WritableComparable is implemented by Writables with the natural order of
+// the corresponding Hadoop class, e.g. for the keys of SortedMapWritable.
+// Like compareTo in Java, CompareTo panics if other is of a different type.
+type WritableComparable interface {
+	Writable
+	CompareTo(other Writable) int
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareFloat64 is Double.compare, which orders -0.0 before 0.0 and NaN
+// after everything else.
+func compareFloat64(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	aBits, bBits := int64(math.Float64bits(a)), int64(math.Float64bits(b))
+	if a != a {
+		aBits = 0x7ff8000000000000
+	}
+	if b != b {
+		bBits = 0x7ff8000000000000
+	}
+	return compareInt64(aBits, bBits)
+}
+
+// Ported from WritableComparator.hashBytes
+func hashBytes(buf []byte) int32 {
+	var hash int32 = 1
+	for _, b := range buf {
+		hash = 31*hash + int32(int8(b))
+	}
+	return hash
+}
+
 type IntWritable int32
 
 func (self *IntWritable) Write(w io.Writer) (int, error) {
@@ -22,6 +74,14 @@ func (self *IntWritable) Read(r io.Reader) error {
 	return binary.Read(r, binary.BigEndian, self)
 }
 
+func (self *IntWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *IntWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*IntWritable)))
+}
+
 type LongWritable int64
 
 func (self *LongWritable) Write(w io.Writer) (int, error) {
@@ -36,6 +96,15 @@ func (self *LongWritable) Read(r io.Reader) error {
 	return binary.Read(r, binary.BigEndian, self)
 }
 
+// HashCode truncates the value, as LongWritable.hashCode does.
+func (self *LongWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *LongWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*LongWritable)))
+}
+
 type TextWritable struct {
 	Buf []byte
 }
@@ -50,21 +119,22 @@ func (self *TextWritable) Write(w io.Writer) (int, error) {
 }
 
 func (self *TextWritable) Read(r io.Reader) error {
-	size, err := ReadVLong(r)
+	buf, err := readBufferInto(r, self.Buf)
 	if err != nil {
 		return err
 	}
-
-	if self.Buf == nil || cap(self.Buf) < int(size) {
-		self.Buf = make([]byte, size)
-	}
-	self.Buf = self.Buf[0:size]
-	if _, err := io.ReadFull(r, self.Buf); err != nil {
-		return err
-	}
+	self.Buf = buf
 	return nil
 }
 
+func (self *TextWritable) HashCode() int32 {
+	return hashBytes(self.Buf)
+}
+
+func (self *TextWritable) CompareTo(other Writable) int {
+	return bytes.Compare(self.Buf, other.(*TextWritable).Buf)
+}
+
 type BytesWritable struct {
 	Buf []byte
 }
@@ -99,3 +169,240 @@ func (self *BytesWritable) Read(r io.Reader) error {
 	}
 	return nil
 }
+
+func (self *BytesWritable) HashCode() int32 {
+	return hashBytes(self.Buf)
+}
+
+func (self *BytesWritable) CompareTo(other Writable) int {
+	return bytes.Compare(self.Buf, other.(*BytesWritable).Buf)
+}
+
+type BooleanWritable bool
+
+func (self *BooleanWritable) Write(w io.Writer) (int, error) {
+	if err := WriteBoolean(w, bool(*self)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (self *BooleanWritable) Read(r io.Reader) error {
+	v, err := ReadBoolean(r)
+	if err != nil {
+		return err
+	}
+	*self = BooleanWritable(v)
+	return nil
+}
+
+// HashCode is 0 for true and 1 for false, as in BooleanWritable.hashCode.
+func (self *BooleanWritable) HashCode() int32 {
+	if *self {
+		return 0
+	}
+	return 1
+}
+
+func (self *BooleanWritable) CompareTo(other Writable) int {
+	that := *other.(*BooleanWritable)
+	if *self == that {
+		return 0
+	} else if that {
+		return -1
+	}
+	return 1
+}
+
+// ByteWritable is signed, like the Java byte it corresponds to.
+type ByteWritable int8
+
+func (self *ByteWritable) Write(w io.Writer) (int, error) {
+	if err := WriteByte(w, byte(*self)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (self *ByteWritable) Read(r io.Reader) error {
+	b, err := ReadByte(r)
+	if err != nil {
+		return err
+	}
+	*self = ByteWritable(b)
+	return nil
+}
+
+func (self *ByteWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *ByteWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*ByteWritable)))
+}
+
+type ShortWritable int16
+
+func (self *ShortWritable) Write(w io.Writer) (int, error) {
+	err := binary.Write(w, binary.BigEndian, self)
+	if err != nil {
+		return 0, err
+	}
+	return 2, nil
+}
+
+func (self *ShortWritable) Read(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, self)
+}
+
+func (self *ShortWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *ShortWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*ShortWritable)))
+}
+
+type FloatWritable float32
+
+func (self *FloatWritable) Write(w io.Writer) (int, error) {
+	err := binary.Write(w, binary.BigEndian, self)
+	if err != nil {
+		return 0, err
+	}
+	return 4, nil
+}
+
+func (self *FloatWritable) Read(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, self)
+}
+
+// HashCode is Float.floatToIntBits, which maps every NaN to the same bits.
+func (self *FloatWritable) HashCode() int32 {
+	v := float32(*self)
+	if v != v {
+		return 0x7fc00000
+	}
+	return int32(math.Float32bits(v))
+}
+
+func (self *FloatWritable) CompareTo(other Writable) int {
+	return compareFloat64(float64(*self), float64(*other.(*FloatWritable)))
+}
+
+type DoubleWritable float64
+
+func (self *DoubleWritable) Write(w io.Writer) (int, error) {
+	err := binary.Write(w, binary.BigEndian, self)
+	if err != nil {
+		return 0, err
+	}
+	return 8, nil
+}
+
+func (self *DoubleWritable) Read(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, self)
+}
+
+// HashCode truncates Double.doubleToLongBits to its lower 32 bits, as
+// DoubleWritable.hashCode does.
+func (self *DoubleWritable) HashCode() int32 {
+	v := float64(*self)
+	if v != v {
+		return 0 // the lower half of 0x7ff8000000000000
+	}
+	return int32(math.Float64bits(v))
+}
+
+func (self *DoubleWritable) CompareTo(other Writable) int {
+	return compareFloat64(float64(*self), float64(*other.(*DoubleWritable)))
+}
+
+// VIntWritable is an int32 in the variable length encoding of WriteVLong.
+type VIntWritable int32
+
+func (self *VIntWritable) Write(w io.Writer) (int, error) {
+	return WriteVInt(w, int32(*self))
+}
+
+func (self *VIntWritable) Read(r io.Reader) error {
+	v, err := ReadVInt(r)
+	if err != nil {
+		return err
+	}
+	*self = VIntWritable(v)
+	return nil
+}
+
+func (self *VIntWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *VIntWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*VIntWritable)))
+}
+
+// VLongWritable is an int64 in the variable length encoding of WriteVLong.
+type VLongWritable int64
+
+func (self *VLongWritable) Write(w io.Writer) (int, error) {
+	return WriteVLong(w, int64(*self))
+}
+
+func (self *VLongWritable) Read(r io.Reader) error {
+	v, err := ReadVLong(r)
+	if err != nil {
+		return err
+	}
+	*self = VLongWritable(v)
+	return nil
+}
+
+// HashCode truncates the value, like LongWritable.HashCode.
+func (self *VLongWritable) HashCode() int32 {
+	return int32(*self)
+}
+
+func (self *VLongWritable) CompareTo(other Writable) int {
+	return compareInt64(int64(*self), int64(*other.(*VLongWritable)))
+}
+
+// NullWritable has no data, e.g. for SequenceFiles that only have keys.
+type NullWritable struct{}
+
+func (self *NullWritable) Write(w io.Writer) (int, error) {
+	return 0, nil
+}
+
+func (self *NullWritable) Read(r io.Reader) error {
+	return nil
+}
+
+func (self *NullWritable) HashCode() int32 {
+	return 0
+}
+
+func (self *NullWritable) CompareTo(other Writable) int {
+	_ = other.(*NullWritable)
+	return 0
+}
+
+// MD5Hash is the 16 byte digest written by Hadoop's MD5Hash.
+type MD5Hash [16]byte
+
+func (self *MD5Hash) Write(w io.Writer) (int, error) {
+	return w.Write(self[:])
+}
+
+func (self *MD5Hash) Read(r io.Reader) error {
+	_, err := io.ReadFull(r, self[:])
+	return err
+}
+
+func (self *MD5Hash) HashCode() int32 {
+	return int32(binary.BigEndian.Uint32(self[:4]))
+}
+
+func (self *MD5Hash) CompareTo(other Writable) int {
+	return bytes.Compare(self[:], other.(*MD5Hash)[:])
+}
@@ -0,0 +1,150 @@
+package hadoop
+
+import (
+	"fmt"
+	"io"
+)
+
+// WritableFactory returns a new, empty Writable to read into, like
+// WritableFactories.newInstance does for a Writable class.
+type WritableFactory func() Writable
+
+// ArrayWritable is an array of Writables of a single class, written as an
+// int32 length followed by the elements. New creates the elements on Read;
+// elements already in Values are reused.
+type ArrayWritable struct {
+	New    WritableFactory
+	Values []Writable
+}
+
+func NewArrayWritable(factory WritableFactory, values ...Writable) *ArrayWritable {
+	return &ArrayWritable{New: factory, Values: values}
+}
+
+func (self *ArrayWritable) Write(w io.Writer) (int, error) {
+	if err := WriteInt(w, int32(len(self.Values))); err != nil {
+		return 0, err
+	}
+	nn, err := writeWritables(w, self.Values)
+	return 4 + nn, err
+}
+
+func (self *ArrayWritable) Read(r io.Reader) error {
+	length, err := readArrayLength(r)
+	if err != nil {
+		return err
+	}
+	self.Values, err = readWritables(r, self.Values, length, self.New)
+	return err
+}
+
+// TwoDArrayWritable is a matrix of Writables of a single class. The number
+// of rows and the length of each row come first, then all elements row by
+// row. Rows may differ in length.
+type TwoDArrayWritable struct {
+	New    WritableFactory
+	Values [][]Writable
+}
+
+func NewTwoDArrayWritable(factory WritableFactory, values ...[]Writable) *TwoDArrayWritable {
+	return &TwoDArrayWritable{New: factory, Values: values}
+}
+
+func (self *TwoDArrayWritable) Write(w io.Writer) (int, error) {
+	if err := WriteInt(w, int32(len(self.Values))); err != nil {
+		return 0, err
+	}
+	nn := 4
+	for _, row := range self.Values {
+		if err := WriteInt(w, int32(len(row))); err != nil {
+			return nn, err
+		}
+		nn += 4
+	}
+	for _, row := range self.Values {
+		n, err := writeWritables(w, row)
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+	}
+	return nn, nil
+}
+
+func (self *TwoDArrayWritable) Read(r io.Reader) error {
+	numRows, err := readArrayLength(r)
+	if err != nil {
+		return err
+	}
+	var lengths []int
+	for i := 0; i < numRows; i++ {
+		length, err := readArrayLength(r)
+		if err != nil {
+			return err
+		}
+		lengths = append(lengths, length)
+	}
+	rows := self.Values
+	if cap(rows) < numRows {
+		rows = make([][]Writable, numRows)
+		copy(rows, self.Values)
+	}
+	rows = rows[:numRows]
+	for i, length := range lengths {
+		rows[i], err = readWritables(r, rows[i], length, self.New)
+		if err != nil {
+			return err
+		}
+	}
+	self.Values = rows
+	return nil
+}
+
+func readArrayLength(r io.Reader) (int, error) {
+	length, err := ReadInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("negative array length %d", length)
+	}
+	return int(length), nil
+}
+
+func writeWritables(w io.Writer, values []Writable) (int, error) {
+	nn := 0
+	for _, value := range values {
+		n, err := value.Write(w)
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+	}
+	return nn, nil
+}
+
+// readWritables reads length elements, reusing those in values. The slice
+// only grows as elements are actually read, so a corrupt length fails on
+// the input running out rather than on allocating memory.
+func readWritables(r io.Reader, values []Writable, length int, factory WritableFactory) ([]Writable, error) {
+	reused := values
+	values = values[:0]
+	for i := 0; i < length; i++ {
+		var value Writable
+		if i < len(reused) && reused[i] != nil {
+			value = reused[i]
+		} else if factory != nil {
+			value = factory()
+		} else {
+			return nil, fmt.Errorf("no factory to create array elements")
+		}
+		if err := value.Read(r); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,125 @@
+package hadoop
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Writables that store other Writables of arbitrary classes, like
+// MapWritable, name those classes by their Java class names. The registry
+// maps a class name to a factory for the Go type implementing the class and
+// back. A Java subclass is best mapped to a Go type embedding the type of
+// its superclass, e.g. a struct embedding ArrayWritable whose factory sets
+// the element factory.
+
+type writableRegistry struct {
+	mutex       sync.RWMutex
+	byClassName map[string]WritableFactory
+	byType      map[reflect.Type]string
+}
+
+var writables = newWritableRegistry(map[string]WritableFactory{
+	"org.apache.hadoop.io.ArrayWritable":     func() Writable { return &ArrayWritable{} },
+	"org.apache.hadoop.io.BooleanWritable":   func() Writable { return new(BooleanWritable) },
+	"org.apache.hadoop.io.BytesWritable":     func() Writable { return &BytesWritable{} },
+	"org.apache.hadoop.io.ByteWritable":      func() Writable { return new(ByteWritable) },
+	"org.apache.hadoop.io.DoubleWritable":    func() Writable { return new(DoubleWritable) },
+	"org.apache.hadoop.io.FloatWritable":     func() Writable { return new(FloatWritable) },
+	"org.apache.hadoop.io.IntWritable":       func() Writable { return new(IntWritable) },
+	"org.apache.hadoop.io.LongWritable":      func() Writable { return new(LongWritable) },
+	"org.apache.hadoop.io.MapWritable":       func() Writable { return &MapWritable{} },
+	"org.apache.hadoop.io.MD5Hash":           func() Writable { return &MD5Hash{} },
+	"org.apache.hadoop.io.NullWritable":      func() Writable { return &NullWritable{} },
+	"org.apache.hadoop.io.ObjectWritable":    func() Writable { return &ObjectWritable{} },
+	"org.apache.hadoop.io.ShortWritable":     func() Writable { return new(ShortWritable) },
+	"org.apache.hadoop.io.SortedMapWritable": func() Writable { return &SortedMapWritable{} },
+	"org.apache.hadoop.io.Text":              func() Writable { return &TextWritable{} },
+	"org.apache.hadoop.io.TwoDArrayWritable": func() Writable { return &TwoDArrayWritable{} },
+	"org.apache.hadoop.io.VIntWritable":      func() Writable { return new(VIntWritable) },
+	"org.apache.hadoop.io.VLongWritable":     func() Writable { return new(VLongWritable) },
+})
+
+func newWritableRegistry(factories map[string]WritableFactory) *writableRegistry {
+	registry := &writableRegistry{
+		byClassName: map[string]WritableFactory{},
+		byType:      map[reflect.Type]string{},
+	}
+	for className, factory := range factories {
+		if err := registry.register(className, factory); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+func (self *writableRegistry) register(className string, factory WritableFactory) error {
+	if className == "" {
+		return fmt.Errorf("writable class name must not be empty")
+	}
+	if factory == nil {
+		return fmt.Errorf("writable factory for %s must not be nil", className)
+	}
+	value := factory()
+	if value == nil {
+		return fmt.Errorf("writable factory for %s returned nil", className)
+	}
+	typ := reflect.TypeOf(value)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if registered, ok := self.byType[typ]; ok && registered != className {
+		return fmt.Errorf("type %v is already registered for %s", typ, registered)
+	}
+	// re-registering a class name replaces the previous registration
+	if previous, ok := self.byClassName[className]; ok {
+		delete(self.byType, reflect.TypeOf(previous()))
+	}
+	self.byClassName[className] = factory
+	self.byType[typ] = className
+	return nil
+}
+
+// RegisterWritable makes the Go type returned by factory known under the
+// Java class name className, so that it can be read from and written to
+// MapWritable, ObjectWritable and the like. A type can only be registered
+// under one class name. Registering a class name again replaces the earlier
+// registration.
+func RegisterWritable(className string, factory WritableFactory) error {
+	return writables.register(className, factory)
+}
+
+// LookupWritable returns the factory registered for a Java class name.
+func LookupWritable(className string) (WritableFactory, bool) {
+	writables.mutex.RLock()
+	defer writables.mutex.RUnlock()
+	factory, ok := writables.byClassName[className]
+	return factory, ok
+}
+
+// WritableClassName returns the Java class name the type of w is registered
+// under.
+func WritableClassName(w Writable) (string, bool) {
+	writables.mutex.RLock()
+	defer writables.mutex.RUnlock()
+	className, ok := writables.byType[reflect.TypeOf(w)]
+	return className, ok
+}
+
+// newWritable creates a Writable of a registered class.
+func newWritable(className string) (Writable, error) {
+	factory, ok := LookupWritable(className)
+	if !ok {
+		return nil, fmt.Errorf("unknown writable class %s", className)
+	}
+	return factory(), nil
+}
+
+// writableClassName is WritableClassName, failing for unregistered types.
+func writableClassName(w Writable) (string, error) {
+	className, ok := WritableClassName(w)
+	if !ok {
+		return "", fmt.Errorf("writable type %T is not registered", w)
+	}
+	return className, nil
+}
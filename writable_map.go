@@ -0,0 +1,305 @@
+package hadoop
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Class ids of AbstractMapWritable for the predefined classes. Other classes
+// get ids from 1 up, listed with their names before the entries.
+var predefinedClassIds = map[string]int8{
+	"org.apache.hadoop.io.ArrayWritable":     -127,
+	"org.apache.hadoop.io.BooleanWritable":   -126,
+	"org.apache.hadoop.io.BytesWritable":     -125,
+	"org.apache.hadoop.io.FloatWritable":     -124,
+	"org.apache.hadoop.io.IntWritable":       -123,
+	"org.apache.hadoop.io.LongWritable":      -122,
+	"org.apache.hadoop.io.MapWritable":       -121,
+	"org.apache.hadoop.io.MD5Hash":           -120,
+	"org.apache.hadoop.io.NullWritable":      -119,
+	"org.apache.hadoop.io.ObjectWritable":    -118,
+	"org.apache.hadoop.io.SortedMapWritable": -117,
+	"org.apache.hadoop.io.Text":              -116,
+	"org.apache.hadoop.io.TwoDArrayWritable": -115,
+	"org.apache.hadoop.io.VIntWritable":      -114,
+	"org.apache.hadoop.io.VLongWritable":     -113,
+}
+
+var predefinedClassNames = func() map[int8]string {
+	names := map[int8]string{}
+	for className, id := range predefinedClassIds {
+		names[id] = className
+	}
+	return names
+}()
+
+type MapWritableEntry struct {
+	Key   Writable
+	Value Writable
+}
+
+// abstractMapWritable reads and writes the format shared by MapWritable and
+// SortedMapWritable: the table of the classes that have no predefined id,
+// then the number of entries and the entries, each key and value preceded
+// by its class id. Keys and values must be of registered types.
+type abstractMapWritable struct {
+	// classes holds the names of the classes with ids 1 and up. The table
+	// read from the input is kept, so that writing reproduces it, and
+	// classes are added to it as they are first written.
+	classes []string
+}
+
+func (self *abstractMapWritable) classId(w Writable) (int8, error) {
+	className, err := writableClassName(w)
+	if err != nil {
+		return 0, err
+	}
+	if id, ok := predefinedClassIds[className]; ok {
+		return id, nil
+	}
+	for i, name := range self.classes {
+		if name == className {
+			return int8(i + 1), nil
+		}
+	}
+	if len(self.classes) == math.MaxInt8 {
+		return 0, fmt.Errorf("too many classes in map")
+	}
+	self.classes = append(self.classes, className)
+	return int8(len(self.classes)), nil
+}
+
+func (self *abstractMapWritable) newEntry(id int8) (Writable, error) {
+	if className, ok := predefinedClassNames[id]; ok {
+		return newWritable(className)
+	}
+	if id < 1 || int(id) > len(self.classes) {
+		return nil, fmt.Errorf("unknown class id %d", id)
+	}
+	return newWritable(self.classes[id-1])
+}
+
+func (self *abstractMapWritable) writeEntries(w io.Writer, entries []MapWritableEntry) (int, error) {
+	// all classes must be in the table before it is written
+	ids := make([]int8, 0, 2*len(entries))
+	for _, entry := range entries {
+		for _, value := range [...]Writable{entry.Key, entry.Value} {
+			id, err := self.classId(value)
+			if err != nil {
+				return 0, err
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	if err := WriteByte(w, byte(len(self.classes))); err != nil {
+		return 0, err
+	}
+	nn := 1
+	for i, className := range self.classes {
+		if err := WriteByte(w, byte(i+1)); err != nil {
+			return nn, err
+		}
+		n, err := WriteUTF(w, className)
+		nn += 1 + n
+		if err != nil {
+			return nn, err
+		}
+	}
+
+	if err := WriteInt(w, int32(len(entries))); err != nil {
+		return nn, err
+	}
+	nn += 4
+	for i, entry := range entries {
+		for j, value := range [...]Writable{entry.Key, entry.Value} {
+			if err := WriteByte(w, byte(ids[2*i+j])); err != nil {
+				return nn, err
+			}
+			n, err := value.Write(w)
+			nn += 1 + n
+			if err != nil {
+				return nn, err
+			}
+		}
+	}
+	return nn, nil
+}
+
+func (self *abstractMapWritable) readEntries(r io.Reader, entries []MapWritableEntry) ([]MapWritableEntry, error) {
+	numClasses, err := ReadByte(r)
+	if err != nil {
+		return nil, err
+	}
+	self.classes = self.classes[:0]
+	for i := 0; i < int(int8(numClasses)); i++ {
+		id, err := ReadByte(r)
+		if err != nil {
+			return nil, err
+		}
+		if int(id) != i+1 {
+			return nil, fmt.Errorf("unexpected class id %d", int8(id))
+		}
+		className, err := ReadUTF(r)
+		if err != nil {
+			return nil, err
+		}
+		self.classes = append(self.classes, className)
+	}
+
+	numEntries, err := readArrayLength(r)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[:0]
+	for i := 0; i < numEntries; i++ {
+		var entry [2]Writable
+		for j := range entry {
+			id, err := ReadByte(r)
+			if err != nil {
+				return nil, err
+			}
+			entry[j], err = self.newEntry(int8(id))
+			if err != nil {
+				return nil, err
+			}
+			if err := entry[j].Read(r); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+		}
+		entries = append(entries, MapWritableEntry{Key: entry[0], Value: entry[1]})
+	}
+	return entries, nil
+}
+
+// MapWritable is Hadoop's MapWritable: a map from Writables to Writables of
+// any registered class. Entries keeps the order of the input, so that a map
+// read from a file is written back byte for byte.
+type MapWritable struct {
+	abstractMapWritable
+	Entries []MapWritableEntry
+}
+
+func (self *MapWritable) Write(w io.Writer) (int, error) {
+	return self.writeEntries(w, self.Entries)
+}
+
+func (self *MapWritable) Read(r io.Reader) error {
+	entries, err := self.readEntries(r, self.Entries)
+	if err != nil {
+		return err
+	}
+	self.Entries = entries
+	return nil
+}
+
+// Get returns the value for a key of the same type and serialized form.
+func (self *MapWritable) Get(key Writable) (Writable, bool) {
+	if i := self.find(key); i >= 0 {
+		return self.Entries[i].Value, true
+	}
+	return nil, false
+}
+
+// Put replaces the value of an equal key, or adds the entry at the end.
+func (self *MapWritable) Put(key Writable, value Writable) {
+	if i := self.find(key); i >= 0 {
+		self.Entries[i].Value = value
+		return
+	}
+	self.Entries = append(self.Entries, MapWritableEntry{Key: key, Value: value})
+}
+
+func (self *MapWritable) find(key Writable) int {
+	for i, entry := range self.Entries {
+		if writablesEqual(entry.Key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// writablesEqual compares Writables by type and serialized form, which is
+// what equals amounts to for the Hadoop classes.
+func writablesEqual(a, b Writable) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	var aBuf, bBuf bytes.Buffer
+	if _, err := a.Write(&aBuf); err != nil {
+		return false
+	}
+	if _, err := b.Write(&bBuf); err != nil {
+		return false
+	}
+	return bytes.Equal(aBuf.Bytes(), bBuf.Bytes())
+}
+
+// SortedMapWritable is Hadoop's SortedMapWritable, a MapWritable whose
+// entries are sorted by key. The keys must implement WritableComparable.
+type SortedMapWritable struct {
+	abstractMapWritable
+	Entries []MapWritableEntry
+}
+
+// Write sorts Entries by key first, as the TreeMap in Java would be.
+func (self *SortedMapWritable) Write(w io.Writer) (int, error) {
+	for _, entry := range self.Entries {
+		if _, ok := entry.Key.(WritableComparable); !ok {
+			return 0, fmt.Errorf("sorted map key %T is not comparable", entry.Key)
+		}
+	}
+	sort.SliceStable(self.Entries, func(i, j int) bool {
+		return self.Entries[i].Key.(WritableComparable).CompareTo(self.Entries[j].Key) < 0
+	})
+	return self.writeEntries(w, self.Entries)
+}
+
+func (self *SortedMapWritable) Read(r io.Reader) error {
+	entries, err := self.readEntries(r, self.Entries)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := entry.Key.(WritableComparable); !ok {
+			return fmt.Errorf("sorted map key %T is not comparable", entry.Key)
+		}
+	}
+	self.Entries = entries
+	return nil
+}
+
+// Get returns the value for a key comparing equal to key.
+func (self *SortedMapWritable) Get(key WritableComparable) (Writable, bool) {
+	i, found := self.search(key)
+	if !found {
+		return nil, false
+	}
+	return self.Entries[i].Value, true
+}
+
+// Put replaces the value of an equal key, or inserts the entry in order.
+func (self *SortedMapWritable) Put(key WritableComparable, value Writable) {
+	i, found := self.search(key)
+	if found {
+		self.Entries[i].Value = value
+		return
+	}
+	self.Entries = append(self.Entries, MapWritableEntry{})
+	copy(self.Entries[i+1:], self.Entries[i:])
+	self.Entries[i] = MapWritableEntry{Key: key, Value: value}
+}
+
+func (self *SortedMapWritable) search(key WritableComparable) (int, bool) {
+	i := sort.Search(len(self.Entries), func(i int) bool {
+		return key.CompareTo(self.Entries[i].Key) <= 0
+	})
+	return i, i < len(self.Entries) && key.CompareTo(self.Entries[i].Key) == 0
+}
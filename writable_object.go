@@ -0,0 +1,418 @@
+package hadoop
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+const (
+	JAVA_STRING_CLASS       = "java.lang.String"
+	WRITABLE_INTERFACE      = "org.apache.hadoop.io.Writable"
+	objectNullInstanceClass = "org.apache.hadoop.io.ObjectWritable$NullInstance"
+	objectCompactArrayClass = "org.apache.hadoop.io.ArrayPrimitiveWritable$Internal"
+)
+
+// JavaEnum is an enum constant held by an ObjectWritable. The enum class is
+// the declared class.
+type JavaEnum string
+
+// The Go types of the Java primitive types held by an ObjectWritable. Arrays
+// of them are slices of these types, e.g. []int32 for int[].
+var primitiveTypes = map[string]reflect.Type{
+	"boolean": reflect.TypeOf(false),
+	"byte":    reflect.TypeOf(int8(0)),
+	"char":    reflect.TypeOf(uint16(0)),
+	"short":   reflect.TypeOf(int16(0)),
+	"int":     reflect.TypeOf(int32(0)),
+	"long":    reflect.TypeOf(int64(0)),
+	"float":   reflect.TypeOf(float32(0)),
+	"double":  reflect.TypeOf(float64(0)),
+}
+
+var primitiveArrayCodes = map[string]string{
+	"boolean": "Z",
+	"byte":    "B",
+	"char":    "C",
+	"short":   "S",
+	"int":     "I",
+	"long":    "J",
+	"float":   "F",
+	"double":  "D",
+}
+
+// ObjectWritable is Hadoop's ObjectWritable: a value of any class, written
+// with the name of its declared class. Instance holds
+//
+//   - nil for null, or for the declared class "void",
+//   - bool, int8, uint16 (char), int16, int32, int64, float32 or float64 for
+//     the Java primitive types,
+//   - string for java.lang.String,
+//   - JavaEnum for enum classes,
+//   - a Writable of a registered type for Writable classes,
+//   - for arrays, a slice of the types above, e.g. []int32 for "[I", or
+//     []interface{} for arrays of objects.
+//
+// If DeclaredClass is empty on Write, it is derived from Instance where
+// possible, like the Java constructor taking just the instance does.
+type ObjectWritable struct {
+	DeclaredClass string
+	Instance      interface{}
+}
+
+func (self *ObjectWritable) Write(w io.Writer) (int, error) {
+	declaredClass := self.DeclaredClass
+	if declaredClass == "" {
+		var err error
+		declaredClass, err = declaredClassOf(self.Instance)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return writeObject(w, declaredClass, self.Instance)
+}
+
+func (self *ObjectWritable) Read(r io.Reader) error {
+	declaredClass, instance, err := readObject(r)
+	if err != nil {
+		return err
+	}
+	self.DeclaredClass = declaredClass
+	self.Instance = instance
+	return nil
+}
+
+func declaredClassOf(instance interface{}) (string, error) {
+	switch instance := instance.(type) {
+	case nil:
+		return "", fmt.Errorf("declared class of null must be set")
+	case string:
+		return JAVA_STRING_CLASS, nil
+	case []string:
+		return arrayClass(JAVA_STRING_CLASS), nil
+	case []byte:
+		return arrayClass("byte"), nil
+	case Writable:
+		return writableClassName(instance)
+	}
+	typ := reflect.TypeOf(instance)
+	isArray := typ.Kind() == reflect.Slice
+	if isArray {
+		typ = typ.Elem()
+	}
+	for className, primitiveType := range primitiveTypes {
+		if typ != primitiveType {
+			continue
+		}
+		if isArray {
+			return arrayClass(className), nil
+		}
+		return className, nil
+	}
+	return "", fmt.Errorf("declared class of %T must be set", instance)
+}
+
+// arrayComponentClass returns the class of the elements of an array class
+// like "[I" or "[Ljava.lang.String;".
+func arrayComponentClass(className string) (string, bool) {
+	if len(className) < 2 || className[0] != '[' {
+		return "", false
+	}
+	code := className[1:]
+	if code[0] == '[' {
+		return code, true
+	}
+	if code[0] == 'L' && strings.HasSuffix(code, ";") {
+		return code[1 : len(code)-1], true
+	}
+	for component, c := range primitiveArrayCodes {
+		if code == c {
+			return component, true
+		}
+	}
+	return "", false
+}
+
+func arrayClass(componentClass string) string {
+	if code, ok := primitiveArrayCodes[componentClass]; ok {
+		return "[" + code
+	}
+	if strings.HasPrefix(componentClass, "[") {
+		return "[" + componentClass
+	}
+	return "[L" + componentClass + ";"
+}
+
+// readPrimitive reads a value of a Java primitive type. It returns false if
+// className is not one.
+func readPrimitive(r io.Reader, className string) (interface{}, bool, error) {
+	if className == "void" {
+		return nil, true, nil
+	}
+	typ, ok := primitiveTypes[className]
+	if !ok {
+		return nil, false, nil
+	}
+	value := reflect.New(typ)
+	if err := binary.Read(r, binary.BigEndian, value.Interface()); err != nil {
+		return nil, true, err
+	}
+	return value.Elem().Interface(), true, nil
+}
+
+// writePrimitive is the inverse of readPrimitive. A byte may also be a uint8.
+func writePrimitive(w io.Writer, className string, value interface{}) (int, bool, error) {
+	if className == "void" {
+		return 0, true, nil
+	}
+	typ, ok := primitiveTypes[className]
+	if !ok {
+		return 0, false, nil
+	}
+	if b, ok := value.(uint8); ok && className == "byte" {
+		value = int8(b)
+	}
+	if reflect.TypeOf(value) != typ {
+		return 0, true, fmt.Errorf("cannot write %T as %s", value, className)
+	}
+	if err := binary.Write(w, binary.BigEndian, value); err != nil {
+		return 0, true, err
+	}
+	return binary.Size(value), true, nil
+}
+
+// readObject is ObjectWritable.readObject. It returns the declared class and
+// the instance.
+func readObject(r io.Reader) (string, interface{}, error) {
+	declaredClass, err := readUTF8(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if value, ok, err := readPrimitive(r, declaredClass); ok {
+		return declaredClass, value, err
+	}
+	if componentClass, ok := arrayComponentClass(declaredClass); ok {
+		values, err := readObjectArray(r, componentClass)
+		return declaredClass, values, err
+	}
+	switch declaredClass {
+	case objectCompactArrayClass:
+		return readCompactArray(r)
+	case JAVA_STRING_CLASS:
+		s, err := readUTF8(r)
+		return declaredClass, s, err
+	}
+
+	// A Writable is followed by the name of its actual class, an enum by
+	// the name of the constant, which cannot contain a dot.
+	name, err := readUTF8(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if name == objectNullInstanceClass {
+		declaredClass, err = readUTF8(r)
+		return declaredClass, nil, err
+	}
+	if _, isWritable := LookupWritable(declaredClass); !isWritable && declaredClass != WRITABLE_INTERFACE && !strings.Contains(name, ".") {
+		return declaredClass, JavaEnum(name), nil
+	}
+	instance, err := newWritable(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := instance.Read(r); err != nil {
+		return "", nil, err
+	}
+	return declaredClass, instance, nil
+}
+
+// readObjectArray reads an array whose elements are written one by one,
+// each with its declared class.
+func readObjectArray(r io.Reader, componentClass string) (interface{}, error) {
+	length, err := readArrayLength(r)
+	if err != nil {
+		return nil, err
+	}
+	values := reflect.ValueOf([]interface{}{})
+	if typ, ok := primitiveTypes[componentClass]; ok {
+		values = reflect.MakeSlice(reflect.SliceOf(typ), 0, 0)
+	}
+	elemType := values.Type().Elem()
+	for i := 0; i < length; i++ {
+		_, value, err := readObject(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		elem := reflect.ValueOf(value)
+		if !elem.IsValid() {
+			elem = reflect.Zero(elemType)
+		}
+		if !elem.Type().AssignableTo(elemType) {
+			return nil, fmt.Errorf("array element %T in array of %s", value, componentClass)
+		}
+		values = reflect.Append(values, elem)
+	}
+	return values.Interface(), nil
+}
+
+// readCompactArray reads an ArrayPrimitiveWritable, which ObjectWritable
+// uses for arrays of primitives when compact arrays are allowed.
+func readCompactArray(r io.Reader) (string, interface{}, error) {
+	componentClass, err := readUTF8(r)
+	if err != nil {
+		return "", nil, err
+	}
+	typ, ok := primitiveTypes[componentClass]
+	if !ok {
+		return "", nil, fmt.Errorf("not a primitive type: %s", componentClass)
+	}
+	length, err := readArrayLength(r)
+	if err != nil {
+		return "", nil, err
+	}
+	values := reflect.MakeSlice(reflect.SliceOf(typ), 0, 0)
+	for i := 0; i < length; i++ {
+		value, _, err := readPrimitive(r, componentClass)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", nil, err
+		}
+		values = reflect.Append(values, reflect.ValueOf(value))
+	}
+	return arrayClass(componentClass), values.Interface(), nil
+}
+
+// writeObject is ObjectWritable.writeObject without compact arrays, which is
+// what ObjectWritable.write uses.
+func writeObject(w io.Writer, declaredClass string, instance interface{}) (int, error) {
+	if instance == nil && declaredClass != "void" {
+		nn := 0
+		for _, s := range [...]string{WRITABLE_INTERFACE, objectNullInstanceClass, declaredClass} {
+			n, err := writeUTF8(w, s)
+			nn += n
+			if err != nil {
+				return nn, err
+			}
+		}
+		return nn, nil
+	}
+
+	nn, err := writeUTF8(w, declaredClass)
+	if err != nil {
+		return nn, err
+	}
+	if n, ok, err := writePrimitive(w, declaredClass, instance); ok {
+		return nn + n, err
+	}
+	if componentClass, ok := arrayComponentClass(declaredClass); ok {
+		values := reflect.ValueOf(instance)
+		if values.Kind() != reflect.Slice {
+			return nn, fmt.Errorf("cannot write %T as %s", instance, declaredClass)
+		}
+		if err := WriteInt(w, int32(values.Len())); err != nil {
+			return nn, err
+		}
+		nn += 4
+		for i := 0; i < values.Len(); i++ {
+			n, err := writeObject(w, componentClass, values.Index(i).Interface())
+			nn += n
+			if err != nil {
+				return nn, err
+			}
+		}
+		return nn, nil
+	}
+
+	switch instance := instance.(type) {
+	case string:
+		if declaredClass != JAVA_STRING_CLASS {
+			break
+		}
+		n, err := writeUTF8(w, instance)
+		return nn + n, err
+	case JavaEnum:
+		n, err := writeUTF8(w, string(instance))
+		return nn + n, err
+	case Writable:
+		className, err := writableClassName(instance)
+		if err != nil {
+			return nn, err
+		}
+		n, err := writeUTF8(w, className)
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+		n, err = instance.Write(w)
+		return nn + n, err
+	}
+	return nn, fmt.Errorf("cannot write %T as %s", instance, declaredClass)
+}
+
+// GenericWritable is Hadoop's GenericWritable: one byte indexing Types,
+// followed by the instance. Types lists the class names of the possible
+// instances in the order of getTypes() of the Java subclass. A subclass is
+// best mapped to a Go type embedding GenericWritable, registered with a
+// factory that sets Types.
+type GenericWritable struct {
+	Types    []string
+	Instance Writable
+}
+
+func NewGenericWritable(types ...string) *GenericWritable {
+	return &GenericWritable{Types: types}
+}
+
+func (self *GenericWritable) Write(w io.Writer) (int, error) {
+	if self.Instance == nil {
+		return 0, fmt.Errorf("generic writable instance not set")
+	}
+	className, err := writableClassName(self.Instance)
+	if err != nil {
+		return 0, err
+	}
+	index := -1
+	for i, typ := range self.Types {
+		if typ == className {
+			index = i
+			break
+		}
+	}
+	if index < 0 || index > 0xff {
+		return 0, fmt.Errorf("class %s is not one of the generic writable types", className)
+	}
+	if err := WriteByte(w, byte(index)); err != nil {
+		return 0, err
+	}
+	n, err := self.Instance.Write(w)
+	return 1 + n, err
+}
+
+func (self *GenericWritable) Read(r io.Reader) error {
+	index, err := ReadByte(r)
+	if err != nil {
+		return err
+	}
+	if int(index) >= len(self.Types) {
+		return fmt.Errorf("generic writable type index %d out of range", index)
+	}
+	instance, err := newWritable(self.Types[index])
+	if err != nil {
+		return err
+	}
+	if err := instance.Read(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	self.Instance = instance
+	return nil
+}
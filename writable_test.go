@@ -0,0 +1,436 @@
+package hadoop
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Expected values were computed with the Java implementations.
+func TestHashCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int32(1), (&TextWritable{}).HashCode())
+	assert.Equal(int32(127791473), (&TextWritable{Buf: []byte("hello")}).HashCode())
+	assert.Equal(int32(127791473), (&BytesWritable{Buf: []byte("hello")}).HashCode())
+	assert.Equal(int32(961), (&BytesWritable{Buf: []byte{0x00, 0x00}}).HashCode())
+	assert.Equal(int32(-3008), (&BytesWritable{Buf: []byte{0x80, 0xff}}).HashCode())
+
+	i := IntWritable(-42)
+	assert.Equal(int32(-42), i.HashCode())
+	l := LongWritable(1<<32 + 5)
+	assert.Equal(int32(5), l.HashCode())
+	l = LongWritable(-1)
+	assert.Equal(int32(-1), l.HashCode())
+
+	assert.Equal(3, HashPartition(&TextWritable{Buf: []byte("hello")}, 10))
+	i = IntWritable(-7)
+	assert.Equal(1, HashPartition(&i, 4))
+}
+
+// testWritableBytes checks that written serializes to expected and that read
+// parses expected back into something that serializes the same.
+func testWritableBytes(t *testing.T, written Writable, read Writable, expected []byte) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	n, err := written.Write(&buf)
+	assert.NoError(err)
+	assert.Equal(len(expected), n)
+	assert.Equal(expected, buf.Bytes(), "%T", written)
+
+	reader := bytes.NewReader(expected)
+	assert.NoError(read.Read(reader))
+	assert.Equal(0, reader.Len(), "%T did not read everything", read)
+	buf.Reset()
+	_, err = read.Write(&buf)
+	assert.NoError(err)
+	assert.Equal(expected, buf.Bytes(), "%T", read)
+}
+
+func TestPrimitiveWritables(t *testing.T) {
+	assert := assert.New(t)
+
+	boolean := BooleanWritable(true)
+	read := new(BooleanWritable)
+	testWritableBytes(t, &boolean, read, []byte{0x01})
+	assert.Equal(boolean, *read)
+	assert.Equal(int32(0), boolean.HashCode())
+	boolean = false
+	testWritableBytes(t, &boolean, new(BooleanWritable), []byte{0x00})
+	assert.Equal(int32(1), boolean.HashCode())
+
+	b := ByteWritable(-5)
+	readByte := new(ByteWritable)
+	testWritableBytes(t, &b, readByte, []byte{0xfb})
+	assert.Equal(b, *readByte)
+	assert.Equal(int32(-5), b.HashCode())
+
+	s := ShortWritable(-300)
+	testWritableBytes(t, &s, new(ShortWritable), []byte{0xfe, 0xd4})
+	assert.Equal(int32(-300), s.HashCode())
+
+	f := FloatWritable(1.5)
+	testWritableBytes(t, &f, new(FloatWritable), []byte{0x3f, 0xc0, 0x00, 0x00})
+	assert.Equal(int32(1069547520), f.HashCode())
+	f = FloatWritable(math.NaN())
+	assert.Equal(int32(2143289344), f.HashCode())
+
+	d := DoubleWritable(-2.25)
+	testWritableBytes(t, &d, new(DoubleWritable), []byte{0xc0, 0x02, 0, 0, 0, 0, 0, 0})
+	assert.Equal(int32(0), d.HashCode())
+	d = 0.1
+	testWritableBytes(t, &d, new(DoubleWritable), []byte{0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a})
+	assert.Equal(int32(-1717986918), d.HashCode())
+
+	for _, c := range []struct {
+		value    int64
+		expected []byte
+	}{
+		{-1, []byte{0xff}},
+		{-112, []byte{0x90}},
+		{-113, []byte{0x87, 0x70}},
+		{127, []byte{0x7f}},
+		{300, []byte{0x8e, 0x01, 0x2c}},
+		{math.MaxInt32, []byte{0x8c, 0x7f, 0xff, 0xff, 0xff}},
+		{math.MinInt32, []byte{0x84, 0x7f, 0xff, 0xff, 0xff}},
+		{1 << 40, []byte{0x8a, 0x01, 0, 0, 0, 0, 0}},
+		{math.MinInt64, []byte{0x80, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		l := VLongWritable(c.value)
+		readLong := new(VLongWritable)
+		testWritableBytes(t, &l, readLong, c.expected)
+		assert.Equal(l, *readLong)
+		if c.value >= math.MinInt32 && c.value <= math.MaxInt32 {
+			i := VIntWritable(c.value)
+			testWritableBytes(t, &i, new(VIntWritable), c.expected)
+			assert.Equal(int32(c.value), i.HashCode())
+		} else {
+			assert.Error(new(VIntWritable).Read(bytes.NewReader(c.expected)))
+		}
+	}
+	l := VLongWritable(1<<32 + 5)
+	assert.Equal(int32(5), l.HashCode())
+
+	testWritableBytes(t, &NullWritable{}, &NullWritable{}, nil)
+	assert.Equal(int32(0), (&NullWritable{}).HashCode())
+}
+
+func newIntWritable(v int32) Writable {
+	i := IntWritable(v)
+	return &i
+}
+
+// Expected bytes were produced with the Java implementations.
+func TestArrayWritable(t *testing.T) {
+	assert := assert.New(t)
+	newInt := func() Writable { return new(IntWritable) }
+	newText := func() Writable { return new(TextWritable) }
+
+	array := NewArrayWritable(newInt, newIntWritable(1), newIntWritable(-2))
+	testWritableBytes(t, array, &ArrayWritable{New: newInt}, []byte{
+		0, 0, 0, 2,
+		0, 0, 0, 1,
+		0xff, 0xff, 0xff, 0xfe,
+	})
+	testWritableBytes(t, NewArrayWritable(newInt), &ArrayWritable{New: newInt}, []byte{0, 0, 0, 0})
+
+	// elements are reused
+	first := array.Values[0]
+	assert.NoError(array.Read(bytes.NewReader([]byte{0, 0, 0, 1, 0, 0, 0, 7})))
+	assert.Equal([]Writable{newIntWritable(7)}, array.Values)
+	assert.True(first == array.Values[0])
+
+	assert.Error(array.Read(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})))
+	assert.Equal(io.ErrUnexpectedEOF, array.Read(bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 1})))
+	assert.Error((&ArrayWritable{}).Read(bytes.NewReader([]byte{0, 0, 0, 1, 0, 0, 0, 1})))
+
+	matrix := NewTwoDArrayWritable(newText,
+		[]Writable{&TextWritable{Buf: []byte("a")}},
+		[]Writable{},
+		[]Writable{&TextWritable{Buf: []byte("b")}, &TextWritable{Buf: []byte("c")}},
+	)
+	testWritableBytes(t, matrix, &TwoDArrayWritable{New: newText}, []byte{
+		0, 0, 0, 3,
+		0, 0, 0, 1,
+		0, 0, 0, 0,
+		0, 0, 0, 2,
+		1, 'a', 1, 'b', 1, 'c',
+	})
+	assert.Equal(io.ErrUnexpectedEOF, matrix.Read(bytes.NewReader([]byte{0, 0, 0, 1, 0, 0, 0, 2, 1, 'a'})))
+}
+
+type testPoint struct {
+	X, Y IntWritable
+}
+
+func (self *testPoint) Write(w io.Writer) (int, error) {
+	if _, err := self.X.Write(w); err != nil {
+		return 0, err
+	}
+	if _, err := self.Y.Write(w); err != nil {
+		return 4, err
+	}
+	return 8, nil
+}
+
+func (self *testPoint) Read(r io.Reader) error {
+	if err := self.X.Read(r); err != nil {
+		return err
+	}
+	return self.Y.Read(r)
+}
+
+func init() {
+	if err := RegisterWritable("com.example.Point", func() Writable { return &testPoint{} }); err != nil {
+		panic(err)
+	}
+}
+
+func TestUTF(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		value    string
+		expected []byte
+	}{
+		{"", []byte{0, 0}},
+		{"abc", []byte{0, 3, 'a', 'b', 'c'}},
+		{"\x00é\U0001f600", []byte{0, 10, 0xc0, 0x80, 0xc3, 0xa9, 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80}},
+	} {
+		var buf bytes.Buffer
+		n, err := WriteUTF(&buf, c.value)
+		assert.NoError(err)
+		assert.Equal(len(c.expected), n)
+		assert.Equal(c.expected, buf.Bytes())
+		value, err := ReadUTF(&buf)
+		assert.NoError(err)
+		assert.Equal(c.value, value)
+	}
+	_, err := ReadUTF(bytes.NewReader([]byte{0, 2, 0xc3, 0x29}))
+	assert.Error(err)
+	_, err = ReadUTF(bytes.NewReader([]byte{0, 2, 'a'}))
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	_, err = WriteUTF(&bytes.Buffer{}, strings.Repeat("é", 40000))
+	assert.Error(err)
+}
+
+func TestRegisterWritable(t *testing.T) {
+	assert := assert.New(t)
+	className, ok := WritableClassName(&testPoint{})
+	assert.True(ok)
+	assert.Equal("com.example.Point", className)
+	className, ok = WritableClassName(new(IntWritable))
+	assert.True(ok)
+	assert.Equal("org.apache.hadoop.io.IntWritable", className)
+	factory, ok := LookupWritable("org.apache.hadoop.io.Text")
+	assert.True(ok)
+	assert.IsType(&TextWritable{}, factory())
+	_, ok = WritableClassName(&struct{ testPoint }{})
+	assert.False(ok)
+
+	assert.Error(RegisterWritable("com.example.OtherPoint", func() Writable { return &testPoint{} }))
+	assert.Error(RegisterWritable("", func() Writable { return &testPoint{} }))
+	assert.Error(RegisterWritable("com.example.Nil", nil))
+}
+
+// Expected bytes were produced with the Java implementations.
+func TestMapWritable(t *testing.T) {
+	assert := assert.New(t)
+	m := &MapWritable{}
+	m.Put(&TextWritable{Buf: []byte("a")}, newIntWritable(1))
+	m.Put(&TextWritable{Buf: []byte("p")}, &testPoint{X: 2, Y: 3})
+	m.Put(&TextWritable{Buf: []byte("a")}, newIntWritable(4))
+	value, ok := m.Get(&TextWritable{Buf: []byte("a")})
+	assert.True(ok)
+	assert.Equal(newIntWritable(4), value)
+	_, ok = m.Get(&BytesWritable{Buf: []byte("a")})
+	assert.False(ok)
+
+	expected := []byte{
+		1, // custom classes
+		1, 0, 17, 'c', 'o', 'm', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'P', 'o', 'i', 'n', 't',
+		0, 0, 0, 2, // entries
+		0x8c, 1, 'a', 0x85, 0, 0, 0, 4,
+		0x8c, 1, 'p', 1, 0, 0, 0, 2, 0, 0, 0, 3,
+	}
+	read := &MapWritable{}
+	testWritableBytes(t, m, read, expected)
+	value, ok = read.Get(&TextWritable{Buf: []byte("p")})
+	assert.True(ok)
+	assert.Equal(&testPoint{X: 2, Y: 3}, value)
+
+	// nested maps and unknown classes
+	outer := &MapWritable{}
+	outer.Put(new(NullWritable), &MapWritable{})
+	testWritableBytes(t, outer, &MapWritable{}, []byte{0, 0, 0, 0, 1, 0x89, 0x87, 0, 0, 0, 0, 0})
+	assert.Error(read.Read(bytes.NewReader([]byte{1, 1, 0, 3, 'F', 'o', 'o', 0, 0, 0, 1, 1})))
+	assert.Error(read.Read(bytes.NewReader([]byte{0, 0, 0, 0, 1, 0x89, 0x88})))
+	assert.Error(read.Read(bytes.NewReader([]byte{0, 0, 0, 0, 1, 0x89, 2})))
+	_, err := (&MapWritable{Entries: []MapWritableEntry{{Key: &struct{ testPoint }{}, Value: new(NullWritable)}}}).Write(&bytes.Buffer{})
+	assert.Error(err)
+}
+
+func TestSortedMapWritable(t *testing.T) {
+	assert := assert.New(t)
+	m := &SortedMapWritable{}
+	m.Put(&TextWritable{Buf: []byte("b")}, new(LongWritable))
+	m.Put(&TextWritable{Buf: []byte("a")}, &NullWritable{})
+	m.Put(&TextWritable{Buf: []byte("c")}, &NullWritable{})
+	l := LongWritable(2)
+	m.Put(&TextWritable{Buf: []byte("b")}, &l)
+	value, ok := m.Get(&TextWritable{Buf: []byte("b")})
+	assert.True(ok)
+	assert.Equal(&l, value)
+	_, ok = m.Get(&TextWritable{Buf: []byte("d")})
+	assert.False(ok)
+
+	testWritableBytes(t, m, &SortedMapWritable{}, []byte{
+		0,
+		0, 0, 0, 3,
+		0x8c, 1, 'a', 0x89,
+		0x8c, 1, 'b', 0x86, 0, 0, 0, 0, 0, 0, 0, 2,
+		0x8c, 1, 'c', 0x89,
+	})
+
+	// entries set directly are sorted on write
+	unsorted := &SortedMapWritable{Entries: []MapWritableEntry{
+		{Key: newIntWritable(3), Value: &NullWritable{}},
+		{Key: newIntWritable(-1), Value: &NullWritable{}},
+	}}
+	testWritableBytes(t, unsorted, &SortedMapWritable{}, []byte{
+		0,
+		0, 0, 0, 2,
+		0x85, 0xff, 0xff, 0xff, 0xff, 0x89,
+		0x85, 0, 0, 0, 3, 0x89,
+	})
+	_, err := (&SortedMapWritable{Entries: []MapWritableEntry{{Key: &testPoint{}, Value: &NullWritable{}}}}).Write(&bytes.Buffer{})
+	assert.Error(err)
+}
+
+func TestCompareTo(t *testing.T) {
+	assert := assert.New(t)
+	i, j := IntWritable(-1), IntWritable(2)
+	assert.Equal(-1, i.CompareTo(&j))
+	assert.Equal(1, j.CompareTo(&i))
+	assert.Equal(0, i.CompareTo(&i))
+	assert.Equal(-1, (&TextWritable{Buf: []byte("a")}).CompareTo(&TextWritable{Buf: []byte("\xff")}))
+	assert.Equal(1, (&TextWritable{Buf: []byte("ab")}).CompareTo(&TextWritable{Buf: []byte("a")}))
+	f, g := BooleanWritable(false), BooleanWritable(true)
+	assert.Equal(-1, f.CompareTo(&g))
+	assert.Equal(1, g.CompareTo(&f))
+	nan, zero, negZero := DoubleWritable(math.NaN()), DoubleWritable(0), DoubleWritable(math.Copysign(0, -1))
+	assert.Equal(1, nan.CompareTo(&zero))
+	assert.Equal(0, nan.CompareTo(&nan))
+	assert.Equal(-1, negZero.CompareTo(&zero))
+	assert.Panics(func() { i.CompareTo(new(LongWritable)) })
+}
+
+// javaUTF returns an ASCII string as written by writeUTF or UTF8.writeString.
+func javaUTF(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var buf []byte
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+// Expected bytes were produced with ObjectWritable.writeObject in Java.
+func TestObjectWritable(t *testing.T) {
+	assert := assert.New(t)
+	text := javaUTF("org.apache.hadoop.io.Text")
+	null := concatBytes(javaUTF("org.apache.hadoop.io.Writable"), javaUTF("org.apache.hadoop.io.ObjectWritable$NullInstance"))
+	for _, c := range []struct {
+		object   ObjectWritable
+		expected []byte
+	}{
+		{ObjectWritable{Instance: &TextWritable{Buf: []byte("a")}}, concatBytes(text, text, []byte{1, 'a'})},
+		{ObjectWritable{Instance: "hi\x00"}, concatBytes(javaUTF("java.lang.String"), javaUTF("hi\x00"))},
+		{ObjectWritable{Instance: int32(42)}, concatBytes(javaUTF("int"), []byte{0, 0, 0, 42})},
+		{ObjectWritable{Instance: true}, concatBytes(javaUTF("boolean"), []byte{1})},
+		{ObjectWritable{DeclaredClass: "char", Instance: uint16('x')}, concatBytes(javaUTF("char"), []byte{0, 'x'})},
+		{ObjectWritable{Instance: float64(-2.25)}, concatBytes(javaUTF("double"), []byte{0xc0, 0x02, 0, 0, 0, 0, 0, 0})},
+		{ObjectWritable{DeclaredClass: "void"}, javaUTF("void")},
+		{ObjectWritable{Instance: []int32{1, 2}}, concatBytes(
+			javaUTF("[I"), []byte{0, 0, 0, 2},
+			javaUTF("int"), []byte{0, 0, 0, 1},
+			javaUTF("int"), []byte{0, 0, 0, 2},
+		)},
+		{ObjectWritable{DeclaredClass: "[Ljava.lang.String;", Instance: []interface{}{"x", nil}}, concatBytes(
+			javaUTF("[Ljava.lang.String;"), []byte{0, 0, 0, 2},
+			javaUTF("java.lang.String"), javaUTF("x"),
+			null, javaUTF("java.lang.String"),
+		)},
+		{ObjectWritable{DeclaredClass: "org.apache.hadoop.io.Text"}, concatBytes(null, text)},
+		{ObjectWritable{DeclaredClass: "java.util.concurrent.TimeUnit", Instance: JavaEnum("SECONDS")}, concatBytes(
+			javaUTF("java.util.concurrent.TimeUnit"), javaUTF("SECONDS"),
+		)},
+		{ObjectWritable{DeclaredClass: WRITABLE_INTERFACE, Instance: newIntWritable(7)}, concatBytes(
+			javaUTF(WRITABLE_INTERFACE), javaUTF("org.apache.hadoop.io.IntWritable"), []byte{0, 0, 0, 7},
+		)},
+	} {
+		read := &ObjectWritable{}
+		testWritableBytes(t, &c.object, read, c.expected)
+		if c.object.DeclaredClass != "" {
+			assert.Equal(c.object.DeclaredClass, read.DeclaredClass)
+		}
+		if _, ok := c.object.Instance.(Writable); !ok {
+			assert.Equal(c.object.Instance, read.Instance)
+		}
+	}
+
+	// ObjectWritable.writeObject with allowCompactArrays
+	read := &ObjectWritable{}
+	assert.NoError(read.Read(bytes.NewReader(concatBytes(
+		javaUTF("org.apache.hadoop.io.ArrayPrimitiveWritable$Internal"), javaUTF("short"), []byte{0, 0, 0, 2, 0xff, 0xff, 0, 3},
+	))))
+	assert.Equal(ObjectWritable{DeclaredClass: "[S", Instance: []int16{-1, 3}}, *read)
+
+	// in a map
+	m := &MapWritable{}
+	m.Put(&ObjectWritable{Instance: "k"}, &ObjectWritable{Instance: int64(1)})
+	testWritableBytes(t, m, &MapWritable{}, concatBytes(
+		[]byte{0, 0, 0, 0, 1},
+		[]byte{0x8a}, javaUTF("java.lang.String"), javaUTF("k"),
+		[]byte{0x8a}, javaUTF("long"), []byte{0, 0, 0, 0, 0, 0, 0, 1},
+	))
+
+	for _, object := range []ObjectWritable{
+		{},
+		{Instance: struct{}{}},
+		{DeclaredClass: "int", Instance: int64(1)},
+		{DeclaredClass: "[I", Instance: 1},
+		{DeclaredClass: "java.lang.Object", Instance: "s"},
+	} {
+		_, err := object.Write(&bytes.Buffer{})
+		assert.Error(err, "%v", object)
+	}
+	assert.Error(read.Read(bytes.NewReader(concatBytes(text, javaUTF("com.example.Unknown")))))
+	assert.Error(read.Read(bytes.NewReader(concatBytes(text, javaUTF("SECONDS")))))
+}
+
+func TestGenericWritable(t *testing.T) {
+	assert := assert.New(t)
+	generic := NewGenericWritable("org.apache.hadoop.io.IntWritable", "org.apache.hadoop.io.Text")
+	generic.Instance = &TextWritable{Buf: []byte("a")}
+	read := NewGenericWritable(generic.Types...)
+	testWritableBytes(t, generic, read, []byte{1, 1, 'a'})
+	assert.Equal(&TextWritable{Buf: []byte("a")}, read.Instance)
+	generic.Instance = newIntWritable(5)
+	testWritableBytes(t, generic, read, []byte{0, 0, 0, 0, 5})
+
+	generic.Instance = new(LongWritable)
+	_, err := generic.Write(&bytes.Buffer{})
+	assert.Error(err)
+	generic.Instance = nil
+	_, err = generic.Write(&bytes.Buffer{})
+	assert.Error(err)
+	assert.Error(read.Read(bytes.NewReader([]byte{2, 0, 0, 0, 0})))
+	assert.Equal(io.ErrUnexpectedEOF, read.Read(bytes.NewReader([]byte{0, 0, 0})))
+}